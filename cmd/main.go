@@ -2,22 +2,35 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/korbiniankuhn/gitops-compose/internal/api"
+	"github.com/korbiniankuhn/gitops-compose/internal/compose"
 	"github.com/korbiniankuhn/gitops-compose/internal/config"
 	"github.com/korbiniankuhn/gitops-compose/internal/docker"
 	"github.com/korbiniankuhn/gitops-compose/internal/git"
 	"github.com/korbiniankuhn/gitops-compose/internal/gitops"
 	"github.com/korbiniankuhn/gitops-compose/internal/metrics"
+	"github.com/korbiniankuhn/gitops-compose/internal/selfupdate"
+	"github.com/korbiniankuhn/gitops-compose/internal/store"
+	"github.com/korbiniankuhn/gitops-compose/internal/webhook"
 )
 
+const webhookMaxBodySize = 25 << 20
+
 func panicOnError(message string, err error) {
 	if err != nil {
 		slog.Error(message, "error", err)
@@ -25,6 +38,109 @@ func panicOnError(message string, err error) {
 	}
 }
 
+func composeOptions(c *config.Config) []compose.ComposeFileOption {
+	return []compose.ComposeFileOption{
+		compose.WithDefaultProfiles(c.DefaultComposeProfiles),
+		compose.WithDefaultDriftPolicy(compose.DriftPolicy(c.DriftPolicy)),
+		compose.WithImageUpdates(c.ImageUpdatesEnabled),
+		compose.WithPinningPolicy(compose.PinningPolicy(c.PinningPolicy)),
+		compose.WithCreateExternal(c.CreateExternalResources),
+	}
+}
+
+// runSelfUpdate is the entrypoint of the controller update helper container
+func runSelfUpdate(c *config.Config, args []string) error {
+	flags := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	file := flags.String("file", "", "compose file of the controller stack")
+	timeout := flags.Duration("timeout", 2*time.Minute, "time the updated controller has to confirm its start")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return fmt.Errorf("missing controller compose file")
+	}
+	if c.StateDirectory == "" {
+		return fmt.Errorf("missing state directory")
+	}
+
+	return selfupdate.RunHelper(compose.NewComposeFile(*file, composeOptions(c)...), c.StateDirectory, *timeout)
+}
+
+// runOnInterval sends the request to the check loop on every interval until
+// done is closed.
+func runOnInterval(interval time.Duration, req gitops.Request, check chan<- gitops.Request, done <-chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case check <- req:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// runPlan asks the running controller for the plan of the next check and
+// prints it to stdout. The plan is computed in the check loop of the
+// controller, the repository must not be fetched by a second process.
+func runPlan(c *config.Config, args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the plan as json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if !c.ApiEnabled || c.ApiToken == "" {
+		return errors.New("the plan is only available with the api enabled and API_TOKEN set")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:2112/api/v1/plan", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.ApiToken)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the controller: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("plan request failed with status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var plan gitops.Plan
+	if err := json.NewDecoder(res.Body).Decode(&plan); err != nil {
+		return fmt.Errorf("invalid plan response: %w", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	fmt.Printf("local %s, remote %s\n\n", plan.LocalCommit, plan.TargetCommit)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, stack := range plan.Stacks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", stack.Action, stack.Name, strings.Join(stack.Reasons, "; "))
+	}
+	return w.Flush()
+}
+
 func main() {
 	// Default logger (will be overwritten during config load)
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
@@ -49,32 +165,63 @@ func main() {
 		slog.SetLogLoggerLevel(slog.Level(c.LogLevel))
 	}
 
-	if c.RepositoryUsername == "" {
+	// Run the controller update helper (started by the previous controller)
+	if len(os.Args) > 1 && os.Args[1] == "self-update" {
+		panicOnError("controller self-update failed", runSelfUpdate(c, os.Args[2:]))
+		return
+	}
+
+	// Print what the next check of the running controller would change
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		panicOnError("failed to plan", runPlan(c, os.Args[2:]))
+		return
+	}
+
+	if c.RepositoryUsername == "" && !c.HasSshKey() {
 		slog.Warn("no credentials set in repository origin")
 	}
 
 	// Verify git repository
-	deploymentRepoOptions := []git.DeploymentRepoOption{}
+	deploymentRepoOptions := []git.DeploymentRepoOption{
+		git.WithBranch(c.RepositoryBranch),
+		git.WithComposeFilePatterns(c.ComposeFilePatterns),
+		git.WithPathFilters(c.ComposeIncludePaths, c.ComposeExcludePaths),
+	}
 	if c.RepositoryUsername != "" {
 		deploymentRepoOptions = append(deploymentRepoOptions, git.WithAuth(c.RepositoryUsername, c.RepositoryPassword))
 	}
+	if c.RepositorySshKeyPath != "" {
+		deploymentRepoOptions = append(deploymentRepoOptions, git.WithSSHKeyFile(c.RepositorySshKeyPath, c.RepositorySshPassphrase, c.RepositorySshKnownHosts))
+	} else if c.RepositorySshKey != "" {
+		deploymentRepoOptions = append(deploymentRepoOptions, git.WithSSHKey([]byte(c.RepositorySshKey), c.RepositorySshPassphrase, c.RepositorySshKnownHosts))
+	}
 	r, err := git.NewDeploymentRepo(c.RepositoryPath, deploymentRepoOptions...)
 	panicOnError("failed to create deployment repo", err)
-	slog.Info("deployment repo initialised", "path", c.RepositoryPath)
+	slog.Info("deployment repo initialised", "path", c.RepositoryPath, "branch", r.Branch())
 
 	// Verify git remote access
 	panicOnError("failed to verify git remote access", r.VerifyRemoteAccess())
-	panicOnError("failed to verify git cli", r.VerifyGitCli())
+	panicOnError("failed to verify git branch", r.VerifyLocalBranch())
 	slog.Info("git remote access verified")
 
+	// Verify git cli (optional, deployments only use go-git)
+	if err := r.VerifyGitCli(); errors.Is(err, git.ErrGitCliNotFound) {
+		slog.Debug("git cli not installed, skipping verification")
+	} else if errors.Is(err, git.ErrGitCliSkipped) {
+		slog.Debug("git cli verification skipped with ssh auth")
+	} else if err != nil {
+		slog.Warn("git cli is not working (not required for deployments)", "error", err)
+	}
+
 	// Verify docker socket connection
 	d := docker.NewDocker(c.DockerRegistries)
 	panicOnError("failed to verify docker socket connection", d.VerifySocketConnection())
 	slog.Info("docker socket connection verified")
 
 	// Warn if dockerised gitops-compose is running on docker desktop
+	isDockerDesktop := false
 	if c.IsRunningInDocker {
-		isDockerDesktop, err := d.IsDockerDesktop()
+		isDockerDesktop, err = d.IsDockerDesktop()
 		panicOnError("failed to verify if docker is running in docker desktop", err)
 		if isDockerDesktop {
 			slog.Warn("docker is running in docker desktop (volume mounts might cause issues)")
@@ -95,50 +242,140 @@ func main() {
 		slog.Info("metrics enabled", "url", "/metrics")
 	}
 
+	// Load persisted state
+	st, err := store.NewStore(c.StateDirectory)
+	panicOnError("failed to load state", err)
+	if st.IsPersistent() {
+		slog.Info("state loaded", "directory", c.StateDirectory, "deployedCommit", st.DeployedCommit())
+	} else {
+		slog.Warn("no state directory set, state is lost on restart")
+	}
+
 	// Initialise gitops
-	g := gitops.NewGitOps(r, d, m)
+	gitopsOptions := []gitops.GitOpsOption{
+		gitops.WithComposeOptions(composeOptions(c)...),
+		gitops.WithStore(st),
+		gitops.WithConcurrency(c.DeploymentConcurrency),
+	}
+	if c.IsRunningInDocker && !isDockerDesktop && st.IsPersistent() {
+		gitopsOptions = append(gitopsOptions, gitops.WithSelfUpdate(c.StateDirectory))
+	}
+
+	g := gitops.NewGitOps(r, d, m, gitopsOptions...)
+
+	// Confirm a controller update (the update helper rolls back otherwise)
+	if c.IsRunningInDocker && !isDockerDesktop && st.IsPersistent() {
+		self, err := d.CurrentContainer()
+		if err != nil {
+			slog.Warn("failed to inspect controller container", "err", err)
+		}
+		h, err := selfupdate.Confirm(c.StateDirectory, self)
+		if err != nil {
+			slog.Warn("failed to confirm controller update", "err", err)
+		} else if h != nil {
+			slog.Info("confirmed controller update", "commit", h.Commit)
+		}
+	}
 
 	wg := sync.WaitGroup{}
-	check := make(chan struct{})
+	check := make(chan gitops.Request)
 
 	// Run gitops check on trigger
 	wg.Add(1)
 	go func() {
-		for range check {
-			g.CheckAndUpdate()
+		for req := range check {
+			g.Process(req)
 		}
 		wg.Done()
 	}()
 
 	// Run check on start
-	check <- struct{}{}
+	check <- gitops.CheckRequest{}
+
+	// Interval triggers stop before the check loop is closed
+	done := make(chan struct{})
+	tickers := sync.WaitGroup{}
 
 	// Run gitops check on interval
 	if c.CheckIntervalInSeconds > 0 {
 		slog.Info(fmt.Sprintf("starting gitops repeated pull (every %s seconds)", fmt.Sprint(c.CheckIntervalInSeconds)))
-		go func() {
-			ticker := time.NewTicker(time.Duration(c.CheckIntervalInSeconds) * time.Second)
-			defer ticker.Stop()
-			for range ticker.C {
-				check <- struct{}{}
-			}
-		}()
+		runOnInterval(time.Duration(c.CheckIntervalInSeconds)*time.Second, gitops.CheckRequest{}, check, done, &tickers)
 	} else {
 		slog.Info("skipping gitops repeated pull (check interval is negative)")
 	}
 
+	// Run full reconciliation on interval (independent of git changes)
+	if c.ReconcileIntervalInSeconds > 0 {
+		slog.Info(fmt.Sprintf("starting periodic reconciliation (every %s seconds)", fmt.Sprint(c.ReconcileIntervalInSeconds)))
+		runOnInterval(time.Duration(c.ReconcileIntervalInSeconds)*time.Second, gitops.ReconcileRequest{}, check, done, &tickers)
+	} else {
+		slog.Info("periodic reconciliation disabled (set RECONCILE_INTERVAL_IN_SECONDS to enable it)")
+	}
+
+	// Check registry digests of mutable image tags on interval (stacks opt in)
+	if c.ImageUpdateIntervalInSeconds > 0 {
+		slog.Info(fmt.Sprintf("starting image update checks (every %s seconds)", fmt.Sprint(c.ImageUpdateIntervalInSeconds)), "default", c.ImageUpdatesEnabled)
+		runOnInterval(time.Duration(c.ImageUpdateIntervalInSeconds)*time.Second, gitops.ImageUpdateRequest{}, check, done, &tickers)
+	} else {
+		slog.Info("skipping image update checks (image update interval is negative)")
+	}
+
 	// Webhook to trigger deployments
 	if c.WebhookEnabled {
+		if c.WebhookSecret == "" {
+			slog.Warn("no webhook secret set, webhook requests are not verified")
+		}
 		http.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBodySize))
+			if err != nil {
+				slog.Warn("failed to read webhook body", "err", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			delivery := webhook.DetectProvider(r)
+			if c.WebhookSecret != "" {
+				delivery, err = webhook.Verify(r, body, c.WebhookSecret)
+				if err != nil {
+					slog.Warn("rejected webhook", "provider", delivery.Provider, "remote", r.RemoteAddr, "err", err)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+
+			if webhook.IsPing(r) {
+				slog.Info("received webhook ping", "provider", delivery.Provider, "delivery", delivery.ID)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			var req gitops.CheckRequest
+			if push, ok := webhook.ParsePush(body); ok {
+				if push.Branch() != c.RepositoryBranch {
+					slog.Info("ignored webhook push to untracked ref", "provider", delivery.Provider, "delivery", delivery.ID, "ref", push.Ref)
+					w.WriteHeader(http.StatusAccepted)
+					return
+				}
+				if c.WebhookFilterPaths {
+					req.ChangedPaths = push.ChangedPaths()
+				}
+			}
+
 			select {
-			case check <- struct{}{}:
-				slog.Info("triggered check via webhook")
+			case check <- req:
+				slog.Info("triggered check via webhook", "provider", delivery.Provider, "delivery", delivery.ID)
 			default:
-				slog.Info("ignored webhook as channel is already full")
+				slog.Info("ignored webhook as channel is already full", "provider", delivery.Provider, "delivery", delivery.ID)
 			}
 			w.WriteHeader(http.StatusAccepted)
 		})
-		slog.Info("webhook enabled", "url", "/webhook")
+		slog.Info("webhook enabled", "url", "/webhook", "verified", c.WebhookSecret != "")
+	}
+
+	// Status api
+	if c.ApiEnabled {
+		api.NewAPI(g, check, c.ApiToken).Register(http.DefaultServeMux)
+		slog.Info("api enabled", "url", "/api/v1/deployments", "actions", c.ApiToken != "")
 	}
 
 	// Health check endpoint
@@ -168,15 +405,18 @@ func main() {
 	<-osSignal
 	slog.Info("received termination signal, shutting down")
 
-	close(check)
-
-	// Stop http server
+	// Stop http server (before closing the check loop, handlers may still send requests)
 	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
 	defer cancel()
 	if err := s.Shutdown(ctx); err != nil {
 		panicOnError("failed to shutdown http server", err)
 	}
 
+	// Stop the interval triggers (a check may still be running), then the check loop
+	close(done)
+	tickers.Wait()
+	close(check)
+
 	// Run until shutdown is complete
 	wg.Wait()
 	slog.Info("gitops compose gracefully stopped")
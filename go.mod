@@ -4,6 +4,7 @@ go 1.24.2
 
 require (
 	github.com/compose-spec/compose-go/v2 v2.6.1
+	github.com/distribution/reference v0.6.0
 	github.com/docker/cli v28.1.0+incompatible
 	github.com/docker/compose/v2 v2.35.1
 	github.com/docker/docker v28.1.1+incompatible
@@ -54,7 +55,6 @@ require (
 	github.com/containerd/typeurl/v2 v2.2.3 // indirect
 	github.com/cyphar/filepath-securejoin v0.4.1 // indirect
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
-	github.com/distribution/reference v0.6.0 // indirect
 	github.com/docker/buildx v0.23.0 // indirect
 	github.com/docker/cli-docs-tool v0.9.0 // indirect
 	github.com/docker/distribution v2.8.3+incompatible // indirect
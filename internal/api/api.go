@@ -0,0 +1,147 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/korbiniankuhn/gitops-compose/internal/gitops"
+)
+
+type API struct {
+	gitops   *gitops.GitOps
+	requests chan<- gitops.Request
+	token    string
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewAPI creates the status API. Manual actions are sent to the check loop
+// through requests and are only enabled with a token.
+func NewAPI(g *gitops.GitOps, requests chan<- gitops.Request, token string) *API {
+	return &API{
+		gitops:   g,
+		requests: requests,
+		token:    token,
+	}
+}
+
+func (a *API) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/deployments", a.listDeployments)
+	mux.HandleFunc("GET /api/v1/deployments/{name...}", a.getDeployment)
+
+	// Planning fetches the remote and blocks the check loop
+	if a.token != "" {
+		mux.HandleFunc("GET /api/v1/plan", a.authenticate(a.getPlan))
+		mux.HandleFunc("POST /api/v1/deployments/{name...}", a.authenticate(a.runAction))
+	}
+}
+
+func (a *API) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			slog.Warn("rejected unauthenticated api request", "path", r.URL.Path, "remote", r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Warn("failed to write api response", "err", err)
+	}
+}
+
+func (a *API) listDeployments(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.gitops.ListDeployments())
+}
+
+func (a *API) getDeployment(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	status, ok := a.gitops.GetDeployment(name)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "deployment not found"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// getPlan fetches the remote in the check loop and returns what a check would
+// change without applying it.
+func (a *API) getPlan(w http.ResponseWriter, r *http.Request) {
+	result := make(chan gitops.PlanResult, 1)
+
+	select {
+	case a.requests <- gitops.PlanRequest{Result: result}:
+	case <-r.Context().Done():
+		return
+	}
+
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: res.Err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, res.Plan)
+	case <-r.Context().Done():
+	}
+}
+
+// runAction handles POST /api/v1/deployments/{name}/{sync|restart|stop}. The
+// name may contain slashes, so the action is the last path segment.
+func (a *API) runAction(w http.ResponseWriter, r *http.Request) {
+	index := strings.LastIndex(r.PathValue("name"), "/")
+	if index < 0 {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "action not found"})
+		return
+	}
+	name := r.PathValue("name")[:index]
+	action := gitops.Action(r.PathValue("name")[index+1:])
+
+	result := make(chan error, 1)
+	req := gitops.ActionRequest{
+		Name:   name,
+		Action: action,
+		Result: result,
+	}
+
+	select {
+	case a.requests <- req:
+	case <-r.Context().Done():
+		return
+	}
+
+	var err error
+	select {
+	case err = <-result:
+	case <-r.Context().Done():
+		return
+	}
+
+	switch {
+	case err == nil:
+		status, _ := a.gitops.GetDeployment(name)
+		writeJSON(w, http.StatusOK, status)
+	case errors.Is(err, gitops.ErrDeploymentNotFound):
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+	case errors.Is(err, gitops.ErrUnknownAction):
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+	case errors.Is(err, gitops.ErrDeploymentNotManaged):
+		writeJSON(w, http.StatusConflict, errorResponse{Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+	}
+}
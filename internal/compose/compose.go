@@ -22,13 +22,155 @@ import (
 )
 
 type ComposeFile struct {
-	Filepath string
+	Filepath           string
+	defaultProfiles    []string
+	defaultDriftPolicy DriftPolicy
+	imageUpdates       bool
+	pinningPolicy      PinningPolicy
+	createExternal     bool
+	workingDirectory   string
 }
 
-func NewComposeFile(filepath string) *ComposeFile {
-	return &ComposeFile{
+type ComposeFileOption func(*ComposeFile)
+
+// WithDefaultProfiles sets the profiles activated for stacks without an
+// x-gitops.profiles extension.
+func WithDefaultProfiles(profiles []string) ComposeFileOption {
+	return func(c *ComposeFile) {
+		c.defaultProfiles = profiles
+	}
+}
+
+// WithImageUpdates enables image update detection for stacks without an
+// x-gitops.image_updates extension.
+func WithImageUpdates(enabled bool) ComposeFileOption {
+	return func(c *ComposeFile) {
+		c.imageUpdates = enabled
+	}
+}
+
+// WithCreateExternal enables the creation of missing external networks and
+// volumes for stacks without an x-gitops.create_external extension.
+func WithCreateExternal(enabled bool) ComposeFileOption {
+	return func(c *ComposeFile) {
+		c.createExternal = enabled
+	}
+}
+
+// WithWorkingDirectory resolves relative paths of the project (bind mounts,
+// build contexts, env files, ...) against directory instead of the directory
+// of the compose file, e.g. for a compose file of an exported commit.
+func WithWorkingDirectory(directory string) ComposeFileOption {
+	return func(c *ComposeFile) {
+		c.workingDirectory = directory
+	}
+}
+
+func NewComposeFile(filepath string, opts ...ComposeFileOption) *ComposeFile {
+	c := &ComposeFile{
 		Filepath: filepath,
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// GitopsConfig holds the root-level x-gitops options of a stack
+type GitopsConfig struct {
+	Profiles       []string           `yaml:"profiles"`
+	Drift          string             `yaml:"drift"`
+	Health         GitopsHealthConfig `yaml:"health"`
+	ImageUpdates   *bool              `yaml:"image_updates"`
+	Pinning        string             `yaml:"pinning"`
+	DependsOn      []string           `yaml:"depends_on"`
+	CreateExternal *bool              `yaml:"create_external"`
+}
+
+func (c ComposeFile) GetGitopsConfig(project *types.Project) GitopsConfig {
+	var cfg GitopsConfig
+	if raw, ok := project.Extensions["x-gitops"]; ok {
+		bytes, _ := yaml.Marshal(raw)
+		if err := yaml.Unmarshal(bytes, &cfg); err != nil {
+			slog.Warn("Failed to unmarshal x-gitops:", "compose", c.Filepath, "error", err)
+		}
+	}
+	return cfg
+}
+
+// Per-directory manifests that may declare additional compose files
+var manifestFilenames = []string{".gitops.yaml", ".gitops.yml"}
+
+type GitopsFilesConfig struct {
+	Files []string `yaml:"files"`
+}
+
+func readFilesConfig(filepath string) (GitopsFilesConfig, error) {
+	var cfg GitopsFilesConfig
+
+	content, err := os.ReadFile(filepath)
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse %s: %w", filepath, err)
+	}
+
+	return cfg, nil
+}
+
+// GetFiles returns the compose file followed by all override files declared in
+// its x-gitops.files extension or in a .gitops.yaml manifest of its directory.
+func (c ComposeFile) GetFiles() ([]string, error) {
+	workingDirectory := path.Dir(c.Filepath)
+	files := []string{c.Filepath}
+
+	var declared []string
+
+	// x-gitops.files of the compose file (read raw, the project needs the files to be loaded)
+	var raw struct {
+		Gitops GitopsFilesConfig `yaml:"x-gitops"`
+	}
+	content, err := os.ReadFile(c.Filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose file: %w", err)
+	}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("invalid compose file: %w", err)
+	}
+	declared = append(declared, raw.Gitops.Files...)
+
+	// Directory manifest
+	for _, filename := range manifestFilenames {
+		manifestPath := filepath.Join(workingDirectory, filename)
+		if _, err := os.Stat(manifestPath); err != nil {
+			continue
+		}
+		cfg, err := readFilesConfig(manifestPath)
+		if err != nil {
+			return nil, err
+		}
+		declared = append(declared, cfg.Files...)
+		break
+	}
+
+	for _, f := range declared {
+		resolved, err := resolvePath(workingDirectory, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve compose file path %s: %w", f, err)
+		}
+		if _, err := os.Stat(resolved); err != nil {
+			return nil, fmt.Errorf("compose file %s not found: %w", f, err)
+		}
+		if !slices.Contains(files, resolved) {
+			files = append(files, resolved)
+		}
+	}
+
+	return files, nil
 }
 
 func (c ComposeFile) LoadProject() (*types.Project, error) {
@@ -36,6 +178,11 @@ func (c ComposeFile) LoadProject() (*types.Project, error) {
 
 	workingDirectory := path.Dir(c.Filepath)
 
+	files, err := c.GetFiles()
+	if err != nil {
+		return &types.Project{}, err
+	}
+
 	optionsFns := []cli.ProjectOptionsFn{}
 
 	envFilePath := filepath.Join(workingDirectory, ".env")
@@ -46,6 +193,10 @@ func (c ComposeFile) LoadProject() (*types.Project, error) {
 		)
 	}
 
+	if c.workingDirectory != "" {
+		workingDirectory = c.workingDirectory
+	}
+
 	optionsFns = append(optionsFns,
 		cli.WithInterpolation(true),
 		cli.WithWorkingDirectory(workingDirectory),
@@ -53,7 +204,7 @@ func (c ComposeFile) LoadProject() (*types.Project, error) {
 	)
 
 	options, err := cli.NewProjectOptions(
-		[]string{c.Filepath},
+		files,
 		optionsFns...,
 	)
 	if err != nil {
@@ -65,6 +216,16 @@ func (c ComposeFile) LoadProject() (*types.Project, error) {
 		return &types.Project{}, fmt.Errorf("invalid compose file: %w", err)
 	}
 
+	// Activate the stack profiles (falls back to the global default)
+	profiles := c.GetGitopsConfig(project).Profiles
+	if profiles == nil {
+		profiles = c.defaultProfiles
+	}
+	project, err = project.WithProfiles(profiles)
+	if err != nil {
+		return &types.Project{}, fmt.Errorf("failed to activate profiles: %w", err)
+	}
+
 	return project, nil
 }
 
@@ -72,7 +233,7 @@ type GitopsWatchConfig struct {
 	Watch []string `yaml:"watch"`
 }
 
-func resolveWatchPath(projectDir, watchPath string) (string, error) {
+func resolvePath(projectDir, watchPath string) (string, error) {
 	if filepath.IsAbs(watchPath) {
 		return filepath.Clean(watchPath), nil
 	}
@@ -114,7 +275,7 @@ func (c ComposeFile) GetWatchFiles(project *types.Project) []string {
 
 	var resolvedWatchFiles []string
 	for _, f := range watchFiles {
-		resolved, err := resolveWatchPath(project.WorkingDir, f)
+		resolved, err := resolvePath(project.WorkingDir, f)
 		if err != nil {
 			slog.Warn("Failed to resolve watch path:", "path", f, "error", err)
 			continue
@@ -125,6 +286,40 @@ func (c ComposeFile) GetWatchFiles(project *types.Project) []string {
 	return resolvedWatchFiles
 }
 
+func (c ComposeFile) ImageUpdatesEnabled(project *types.Project) bool {
+	if enabled := c.GetGitopsConfig(project).ImageUpdates; enabled != nil {
+		return *enabled
+	}
+	return c.imageUpdates
+}
+
+func (c ComposeFile) CreateExternalEnabled(project *types.Project) bool {
+	if enabled := c.GetGitopsConfig(project).CreateExternal; enabled != nil {
+		return *enabled
+	}
+	return c.createExternal
+}
+
+// ExternalResources returns the names of the external networks and volumes
+// the project references.
+func ExternalResources(project *types.Project) ([]string, []string) {
+	networks := []string{}
+	for _, n := range project.Networks {
+		if bool(n.External) && !slices.Contains(networks, n.Name) {
+			networks = append(networks, n.Name)
+		}
+	}
+	volumes := []string{}
+	for _, v := range project.Volumes {
+		if bool(v.External) && !slices.Contains(volumes, v.Name) {
+			volumes = append(volumes, v.Name)
+		}
+	}
+	slices.Sort(networks)
+	slices.Sort(volumes)
+	return networks, volumes
+}
+
 func (c ComposeFile) ListImages() ([]string, error) {
 	project, err := c.LoadProject()
 	if err != nil {
@@ -156,15 +351,19 @@ func getService() (api.Service, error) {
 	return compose.NewComposeService(dockerCli), nil
 }
 
-func (c ComposeFile) IsRunning() (bool, error) {
-	service, err := getService()
+func (c ComposeFile) ps() ([]api.ContainerSummary, error) {
+	project, err := c.LoadProject()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	project, err := c.LoadProject()
+	return psProject(project)
+}
+
+func psProject(project *types.Project) ([]api.ContainerSummary, error) {
+	service, err := getService()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	ctx := context.Background()
@@ -181,7 +380,16 @@ func (c ComposeFile) IsRunning() (bool, error) {
 	})
 
 	if err != nil {
-		return false, fmt.Errorf("docker compose ps failed: %w", err)
+		return nil, fmt.Errorf("docker compose ps failed: %w", err)
+	}
+
+	return containers, nil
+}
+
+func (c ComposeFile) IsRunning() (bool, error) {
+	containers, err := c.ps()
+	if err != nil {
+		return false, err
 	}
 
 	if len(containers) == 0 {
@@ -197,6 +405,140 @@ func (c ComposeFile) IsRunning() (bool, error) {
 	return false, nil
 }
 
+type ContainerStatus struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Service  string `json:"service"`
+	Image    string `json:"image"`
+	State    string `json:"state"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exitCode"`
+	Health   string `json:"health,omitempty"`
+}
+
+func newContainerStatus(container api.ContainerSummary) ContainerStatus {
+	return ContainerStatus{
+		ID:       container.ID,
+		Name:     container.Name,
+		Service:  container.Service,
+		Image:    container.Image,
+		State:    container.State,
+		Status:   container.Status,
+		ExitCode: container.ExitCode,
+		Health:   container.Health,
+	}
+}
+
+func (c ComposeFile) Containers() ([]ContainerStatus, error) {
+	containers, err := c.ps()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []ContainerStatus{}
+	for _, container := range containers {
+		statuses = append(statuses, newContainerStatus(container))
+	}
+
+	return statuses, nil
+}
+
+// ServiceStatus compares the desired replicas of a service with its containers
+type ServiceStatus struct {
+	Service         string            `json:"service"`
+	DesiredReplicas int               `json:"desiredReplicas"`
+	RunningReplicas int               `json:"runningReplicas"`
+	Containers      []ContainerStatus `json:"containers"`
+}
+
+func (s ServiceStatus) IsComplete() bool {
+	return s.RunningReplicas >= s.DesiredReplicas
+}
+
+type ProjectStatus struct {
+	Services []ServiceStatus `json:"services"`
+}
+
+// IsRunning reports whether any container of the project is running
+func (s ProjectStatus) IsRunning() bool {
+	for _, service := range s.Services {
+		for _, container := range service.Containers {
+			if container.State == "running" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Incomplete returns the services with less running replicas than desired
+func (s ProjectStatus) Incomplete() []string {
+	services := []string{}
+	for _, service := range s.Services {
+		if !service.IsComplete() {
+			services = append(services, service.Service)
+		}
+	}
+	return services
+}
+
+func (s ProjectStatus) IsComplete() bool {
+	return len(s.Incomplete()) == 0
+}
+
+// isSatisfied reports whether a container counts towards the desired replicas.
+// Unhealthy containers do not count (unless healthchecks are disabled),
+// containers that exited successfully without being restarted (e.g. init
+// jobs) are considered done.
+func isSatisfied(container api.ContainerSummary, restart string, healthchecks bool) bool {
+	if container.State == "running" {
+		return !healthchecks || container.Health != "unhealthy"
+	}
+	return container.State == "exited" && container.ExitCode == 0 && restart != "always" && restart != "unless-stopped"
+}
+
+// Status returns the per service status of the project (one-off containers
+// are ignored)
+func (c ComposeFile) Status() (ProjectStatus, error) {
+	project, err := c.LoadProject()
+	if err != nil {
+		return ProjectStatus{}, err
+	}
+
+	return projectStatus(project, c.GetHealthPolicy(project).Healthchecks)
+}
+
+func projectStatus(project *types.Project, healthchecks bool) (ProjectStatus, error) {
+	containers, err := psProject(project)
+	if err != nil {
+		return ProjectStatus{}, err
+	}
+
+	status := ProjectStatus{
+		Services: []ServiceStatus{},
+	}
+	for _, name := range project.ServiceNames() {
+		service := project.Services[name]
+		serviceStatus := ServiceStatus{
+			Service:         service.Name,
+			DesiredReplicas: service.GetScale(),
+			Containers:      []ContainerStatus{},
+		}
+		for _, container := range containers {
+			if container.Service != service.Name || container.Labels[api.OneoffLabel] == "True" {
+				continue
+			}
+			if isSatisfied(container, service.Restart, healthchecks) {
+				serviceStatus.RunningReplicas++
+			}
+			serviceStatus.Containers = append(serviceStatus.Containers, newContainerStatus(container))
+		}
+		status.Services = append(status.Services, serviceStatus)
+	}
+
+	return status, nil
+}
+
 func (c ComposeFile) Stop() error {
 	service, err := getService()
 	if err != nil {
@@ -210,6 +552,10 @@ func (c ComposeFile) Stop() error {
 
 	ctx := context.Background()
 
+	if err := removeDisabledServices(ctx, service, project); err != nil {
+		return err
+	}
+
 	if err := service.Down(ctx, project.Name, api.DownOptions{
 		RemoveOrphans: true,
 		Project:       project,
@@ -222,13 +568,22 @@ func (c ComposeFile) Stop() error {
 	return nil
 }
 
-func (c ComposeFile) Start() error {
-	service, err := getService()
-	if err != nil {
-		return err
-	}
+// StartProject starts an already loaded project (e.g. a previous revision of
+// the stack) and waits according to its health policy. All containers are
+// recreated.
+func (c ComposeFile) StartProject(project *types.Project) error {
+	return c.up(project, nil, api.RecreateForce)
+}
 
-	project, err := c.LoadProject()
+// StartServices starts the given services (all if empty) of an already loaded
+// project. Only containers whose configuration or image diverges from the
+// project are recreated, other services are left untouched.
+func (c ComposeFile) StartServices(project *types.Project, services []string) error {
+	return c.up(project, services, api.RecreateDiverged)
+}
+
+func (c ComposeFile) up(project *types.Project, services []string, recreate string) error {
+	service, err := getService()
 	if err != nil {
 		return err
 	}
@@ -247,19 +602,37 @@ func (c ComposeFile) Start() error {
 
 	ctx := context.Background()
 
-	err = service.Up(ctx, project, api.UpOptions{
+	if err := removeDisabledServices(ctx, service, project); err != nil {
+		return err
+	}
+
+	// Limit the project to the services and their dependencies, the other
+	// services must not be removed as orphans
+	selected := project
+	removeOrphans := true
+	recreateDependencies := recreate
+	if len(services) > 0 {
+		selected, err = project.WithSelectedServices(services)
+		if err != nil {
+			return fmt.Errorf("failed to select services: %w", err)
+		}
+		removeOrphans = false
+		recreateDependencies = api.RecreateNever
+	}
+
+	err = service.Up(ctx, selected, api.UpOptions{
 		Create: api.CreateOptions{
-			RemoveOrphans:        true,
-			Recreate:             api.RecreateForce,
-			RecreateDependencies: api.RecreateForce,
+			Services:             services,
+			RemoveOrphans:        removeOrphans,
+			Recreate:             recreate,
+			RecreateDependencies: recreateDependencies,
 			QuietPull:            true,
 			AssumeYes:            true,
-			Timeout:              func() *time.Duration { d := time.Duration(180) * time.Second; return &d }(),
+			Timeout:              func() *time.Duration { d := stopTimeout; return &d }(),
 		},
 		Start: api.StartOptions{
-			Project:     project,
-			Wait:        true,
-			WaitTimeout: time.Duration(180) * time.Second,
+			Project:  selected,
+			Services: services,
 		},
 	})
 
@@ -267,5 +640,45 @@ func (c ComposeFile) Start() error {
 		return fmt.Errorf("docker compose up failed: %w", err)
 	}
 
+	// Wait for the stack to become healthy (compose only waits for dependencies)
+	return waitHealthy(project, c.GetHealthPolicy(project))
+}
+
+// removeDisabledServices removes the containers of services whose profile is
+// not active (anymore). Compose knows them from the project and does not
+// remove them as orphans.
+func removeDisabledServices(ctx context.Context, service api.Service, project *types.Project) error {
+	disabled := project.DisabledServiceNames()
+	if len(disabled) == 0 {
+		return nil
+	}
+
+	containers, err := service.Ps(ctx, project.Name, api.PsOptions{
+		All:      true,
+		Services: disabled,
+	})
+	if err != nil {
+		return fmt.Errorf("docker compose ps failed: %w", err)
+	}
+
+	services := []string{}
+	for _, container := range containers {
+		if !slices.Contains(services, container.Service) {
+			services = append(services, container.Service)
+		}
+	}
+	if len(services) == 0 {
+		return nil
+	}
+
+	slog.Info("removing services of inactive profiles", "project", project.Name, "services", services)
+	if err := service.Remove(ctx, project.Name, api.RemoveOptions{
+		Services: services,
+		Stop:     true,
+		Force:    true,
+	}); err != nil {
+		return fmt.Errorf("failed to remove services of inactive profiles: %w", err)
+	}
+
 	return nil
 }
@@ -0,0 +1,120 @@
+package compose
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/compose-spec/compose-go/v2/types"
+	"github.com/docker/compose/v2/pkg/api"
+	"github.com/docker/compose/v2/pkg/compose"
+)
+
+type DriftPolicy string
+
+const (
+	DriftIgnore  DriftPolicy = "ignore"
+	DriftReport  DriftPolicy = "report"
+	DriftCorrect DriftPolicy = "correct"
+)
+
+func (p DriftPolicy) IsValid() bool {
+	return p == DriftIgnore || p == DriftReport || p == DriftCorrect
+}
+
+// WithDefaultDriftPolicy sets the drift policy for stacks without an
+// x-gitops.drift extension.
+func WithDefaultDriftPolicy(policy DriftPolicy) ComposeFileOption {
+	return func(c *ComposeFile) {
+		c.defaultDriftPolicy = policy
+	}
+}
+
+// ServiceDrift describes a service whose containers differ from the desired
+// project (count or compose config hash).
+type ServiceDrift struct {
+	Service            string   `json:"service"`
+	DesiredReplicas    int      `json:"desiredReplicas"`
+	RunningReplicas    int      `json:"runningReplicas"`
+	OutdatedContainers []string `json:"outdatedContainers,omitempty"`
+}
+
+func (c ComposeFile) GetDriftPolicy() (DriftPolicy, error) {
+	project, err := c.LoadProject()
+	if err != nil {
+		return "", err
+	}
+
+	policy := DriftPolicy(c.GetGitopsConfig(project).Drift)
+	if policy == "" {
+		policy = c.defaultDriftPolicy
+	}
+	if policy == "" {
+		policy = DriftReport
+	}
+	if !policy.IsValid() {
+		slog.Warn("invalid x-gitops drift policy, using report", "compose", c.Filepath, "policy", policy)
+		policy = DriftReport
+	}
+
+	return policy, nil
+}
+
+// DetectDrift compares the containers of each service with the desired project
+func (c ComposeFile) DetectDrift() ([]ServiceDrift, error) {
+	project, err := c.LoadProject()
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := c.ps()
+	if err != nil {
+		return nil, err
+	}
+
+	healthchecks := c.GetHealthPolicy(project).Healthchecks
+
+	drifts := []ServiceDrift{}
+	for _, service := range project.Services {
+		hash, err := compose.ServiceHash(service)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute service hash: %w", err)
+		}
+
+		drift := ServiceDrift{
+			Service:            service.Name,
+			DesiredReplicas:    service.GetScale(),
+			OutdatedContainers: []string{},
+		}
+		for _, container := range containers {
+			if container.Service != service.Name || container.Labels[api.OneoffLabel] == "True" {
+				continue
+			}
+			if isSatisfied(container, service.Restart, healthchecks) {
+				drift.RunningReplicas++
+			}
+			if container.Labels[api.ConfigHashLabel] != hash {
+				drift.OutdatedContainers = append(drift.OutdatedContainers, container.Name)
+			}
+		}
+
+		if drift.RunningReplicas != drift.DesiredReplicas || len(drift.OutdatedContainers) > 0 {
+			drifts = append(drifts, drift)
+		}
+	}
+
+	return drifts, nil
+}
+
+// ServiceHashes returns the compose config hash each service container of the
+// project is labeled with
+func ServiceHashes(project *types.Project) (map[string]string, error) {
+	hashes := map[string]string{}
+	for _, service := range project.Services {
+		hash, err := compose.ServiceHash(service)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute service hash: %w", err)
+		}
+		hashes[service.Name] = hash
+	}
+	return hashes, nil
+}
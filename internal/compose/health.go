@@ -0,0 +1,133 @@
+package compose
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/compose-spec/compose-go/v2/types"
+)
+
+var (
+	ErrUnhealthy       = fmt.Errorf("stack did not become healthy")
+	ErrContainerExited = fmt.Errorf("container exited")
+)
+
+type TimeoutPolicy string
+
+const (
+	TimeoutFail     TimeoutPolicy = "fail"
+	TimeoutRollback TimeoutPolicy = "rollback"
+	TimeoutKeep     TimeoutPolicy = "keep"
+)
+
+const (
+	defaultWaitTimeout = 180 * time.Second
+	stopTimeout        = 180 * time.Second
+	waitInterval       = 2 * time.Second
+)
+
+// GitopsHealthConfig is the x-gitops.health extension of a stack
+type GitopsHealthConfig struct {
+	Timeout      string `yaml:"timeout"`
+	Healthchecks *bool  `yaml:"healthchecks"`
+	OnTimeout    string `yaml:"on_timeout"`
+}
+
+// HealthPolicy defines how long a started stack may take to become healthy
+// and what happens afterwards.
+type HealthPolicy struct {
+	Timeout      time.Duration
+	Healthchecks bool
+	OnTimeout    TimeoutPolicy
+}
+
+func (c ComposeFile) GetHealthPolicy(project *types.Project) HealthPolicy {
+	policy := HealthPolicy{
+		Timeout:      defaultWaitTimeout,
+		Healthchecks: true,
+		OnTimeout:    TimeoutRollback,
+	}
+
+	cfg := c.GetGitopsConfig(project).Health
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil || timeout <= 0 {
+			slog.Warn("invalid x-gitops health timeout, using default", "compose", c.Filepath, "timeout", cfg.Timeout)
+		} else {
+			policy.Timeout = timeout
+		}
+	}
+	if cfg.Healthchecks != nil {
+		policy.Healthchecks = *cfg.Healthchecks
+	}
+	switch TimeoutPolicy(cfg.OnTimeout) {
+	case "":
+	case TimeoutFail, TimeoutRollback, TimeoutKeep:
+		policy.OnTimeout = TimeoutPolicy(cfg.OnTimeout)
+	default:
+		slog.Warn("invalid x-gitops health on_timeout, using rollback", "compose", c.Filepath, "onTimeout", cfg.OnTimeout)
+	}
+
+	return policy
+}
+
+// isReady reports whether all services run their desired replicas and (if
+// enabled) passed their healthchecks.
+func (s ProjectStatus) isReady(healthchecks bool) bool {
+	if !s.IsComplete() {
+		return false
+	}
+	if !healthchecks {
+		return true
+	}
+	for _, service := range s.Services {
+		for _, container := range service.Containers {
+			if container.State == "running" && container.Health != "" && container.Health != "healthy" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// waitHealthy polls the project until it is ready or the policy timeout is
+// reached. Containers that exited with an error and are not restarted fail
+// immediately.
+func waitHealthy(project *types.Project, policy HealthPolicy) error {
+	deadline := time.Now().Add(policy.Timeout)
+	for {
+		status, err := projectStatus(project, policy.Healthchecks)
+		if err != nil {
+			return err
+		}
+		if status.isReady(policy.Healthchecks) {
+			return nil
+		}
+
+		for _, service := range status.Services {
+			restart := project.Services[service.Service].Restart
+			for _, container := range service.Containers {
+				if container.State == "exited" && container.ExitCode != 0 && (restart == "" || restart == "no") {
+					return fmt.Errorf("%w: %s (exit code %d)", ErrContainerExited, container.Name, container.ExitCode)
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w after %s: %v", ErrUnhealthy, policy.Timeout, status.notReady(policy.Healthchecks))
+		}
+		time.Sleep(waitInterval)
+	}
+}
+
+func (s ProjectStatus) notReady(healthchecks bool) []string {
+	services := []string{}
+	for _, service := range s.Services {
+		ready := ProjectStatus{Services: []ServiceStatus{service}}.isReady(healthchecks)
+		if !ready {
+			services = append(services, service.Service)
+		}
+	}
+	return services
+}
@@ -0,0 +1,72 @@
+package compose
+
+import (
+	"log/slog"
+
+	"github.com/compose-spec/compose-go/v2/types"
+	"github.com/distribution/reference"
+)
+
+type PinningPolicy string
+
+const (
+	PinningOff     PinningPolicy = "off"
+	PinningWarn    PinningPolicy = "warn"
+	PinningEnforce PinningPolicy = "enforce"
+)
+
+func (p PinningPolicy) IsValid() bool {
+	return p == PinningOff || p == PinningWarn || p == PinningEnforce
+}
+
+// WithPinningPolicy sets the pinning policy for stacks without an
+// x-gitops.pinning extension.
+func WithPinningPolicy(policy PinningPolicy) ComposeFileOption {
+	return func(c *ComposeFile) {
+		c.pinningPolicy = policy
+	}
+}
+
+// IsPinned reports whether an image reference has a digest or a tag other
+// than latest.
+func IsPinned(image string) bool {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false
+	}
+	if _, ok := ref.(reference.Digested); ok {
+		return true
+	}
+	if tagged, ok := ref.(reference.Tagged); ok {
+		return tagged.Tag() != "latest"
+	}
+	return false
+}
+
+func (c ComposeFile) GetPinningPolicy(project *types.Project) PinningPolicy {
+	policy := PinningPolicy(c.GetGitopsConfig(project).Pinning)
+	if policy == "" {
+		policy = c.pinningPolicy
+	}
+	if policy == "" {
+		policy = PinningOff
+	}
+	if !policy.IsValid() {
+		slog.Warn("invalid x-gitops pinning policy, using warn", "compose", c.Filepath, "policy", policy)
+		policy = PinningWarn
+	}
+	return policy
+}
+
+// UnpinnedImages returns the service images without digest or with no or the
+// latest tag (services without image are built locally and skipped).
+func (c ComposeFile) UnpinnedImages(project *types.Project) []string {
+	images := []string{}
+	for _, name := range project.ServiceNames() {
+		image := project.Services[name].Image
+		if image != "" && !IsPinned(image) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
@@ -19,17 +19,43 @@ import (
 type LogFormatDecoder string
 
 type LogLevelDecoder slog.Level
+
+type DriftPolicyDecoder string
+
+type PinningPolicyDecoder string
+
 type Config struct {
-	CheckIntervalInSeconds int                     `default:"300" split_words:"true"`
-	RepositoryPath         string                  `required:"true" split_words:"true"`
-	RepositoryUsername     string                  `ignored:"true"`
-	RepositoryPassword     string                  `ignored:"true"`
-	WebhookEnabled         bool                    `default:"true" split_words:"true"`
-	MetricsEnabled         bool                    `default:"true" split_words:"true"`
-	DockerRegistries       DockerRegistriesDecoder `default:"[]" split_words:"true"`
-	IsRunningInDocker      bool                    `default:"false" split_words:"true"`
-	LogFormat              LogFormatDecoder        `default:"text" split_words:"true"`
-	LogLevel               LogLevelDecoder         `default:"info" split_words:"true"`
+	CheckIntervalInSeconds       int                     `default:"300" split_words:"true"`
+	ReconcileIntervalInSeconds   int                     `default:"-1" split_words:"true"`
+	RepositoryPath               string                  `required:"true" split_words:"true"`
+	RepositoryBranch             string                  `default:"main" split_words:"true"`
+	RepositoryUsername           string                  `ignored:"true"`
+	RepositoryPassword           string                  `ignored:"true"`
+	RepositorySshKeyPath         string                  `split_words:"true"`
+	RepositorySshKey             string                  `split_words:"true"`
+	RepositorySshPassphrase      string                  `split_words:"true"`
+	RepositorySshKnownHosts      string                  `split_words:"true"`
+	ComposeFilePatterns          []string                `default:"compose.yaml,compose.yml,docker-compose.yaml,docker-compose.yml" split_words:"true"`
+	ComposeIncludePaths          []string                `split_words:"true"`
+	ComposeExcludePaths          []string                `split_words:"true"`
+	DefaultComposeProfiles       []string                `split_words:"true"`
+	ImageUpdatesEnabled          bool                    `default:"false" split_words:"true"`
+	ImageUpdateIntervalInSeconds int                     `default:"3600" split_words:"true"`
+	CreateExternalResources      bool                    `default:"false" split_words:"true"`
+	DeploymentConcurrency        int                     `default:"1" split_words:"true"`
+	PinningPolicy                PinningPolicyDecoder    `default:"off" split_words:"true"`
+	DriftPolicy                  DriftPolicyDecoder      `default:"report" split_words:"true"`
+	StateDirectory               string                  `split_words:"true"`
+	WebhookEnabled               bool                    `default:"true" split_words:"true"`
+	WebhookSecret                string                  `split_words:"true"`
+	WebhookFilterPaths           bool                    `default:"false" split_words:"true"`
+	ApiEnabled                   bool                    `default:"true" split_words:"true"`
+	ApiToken                     string                  `split_words:"true"`
+	MetricsEnabled               bool                    `default:"true" split_words:"true"`
+	DockerRegistries             DockerRegistriesDecoder `default:"[]" split_words:"true"`
+	IsRunningInDocker            bool                    `default:"false" split_words:"true"`
+	LogFormat                    LogFormatDecoder        `default:"text" split_words:"true"`
+	LogLevel                     LogLevelDecoder         `default:"info" split_words:"true"`
 }
 
 func getCredentialsFromRepository(path string) (string, string) {
@@ -62,6 +88,11 @@ func getCredentialsFromRepository(path string) (string, string) {
 		return "", ""
 	}
 
+	// Only http remotes carry basic auth credentials
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", ""
+	}
+
 	var username, password string
 
 	if u.User != nil {
@@ -97,6 +128,28 @@ func (f *LogFormatDecoder) UnmarshalText(text []byte) error {
 	}
 }
 
+func (p *DriftPolicyDecoder) UnmarshalText(text []byte) error {
+	value := strings.ToLower(string(text))
+	switch value {
+	case "ignore", "report", "correct":
+		*p = DriftPolicyDecoder(value)
+		return nil
+	default:
+		return fmt.Errorf("invalid drift policy: %s", value)
+	}
+}
+
+func (p *PinningPolicyDecoder) UnmarshalText(text []byte) error {
+	value := strings.ToLower(string(text))
+	switch value {
+	case "off", "warn", "enforce":
+		*p = PinningPolicyDecoder(value)
+		return nil
+	default:
+		return fmt.Errorf("invalid pinning policy: %s", value)
+	}
+}
+
 func (l *LogLevelDecoder) UnmarshalText(text []byte) error {
 	value := strings.ToLower(string(text))
 	switch value {
@@ -129,8 +182,16 @@ func Get() (*Config, error) {
 		}
 	}
 
+	if config.RepositorySshKeyPath != "" && config.RepositorySshKey != "" {
+		return nil, fmt.Errorf("only one of REPOSITORY_SSH_KEY_PATH and REPOSITORY_SSH_KEY can be set")
+	}
+
 	// Get credentials from repository origin
 	config.RepositoryUsername, config.RepositoryPassword = getCredentialsFromRepository(config.RepositoryPath)
 
 	return &config, nil
 }
+
+func (c Config) HasSshKey() bool {
+	return c.RepositorySshKeyPath != "" || c.RepositorySshKey != ""
+}
@@ -1,14 +1,19 @@
 package deployment
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 
+	"github.com/compose-spec/compose-go/v2/types"
 	"github.com/korbiniankuhn/gitops-compose/internal/compose"
 	"github.com/korbiniankuhn/gitops-compose/internal/docker"
 	"github.com/korbiniankuhn/gitops-compose/internal/utils"
@@ -18,6 +23,8 @@ var (
 	ErrInvalidComposeFile     = fmt.Errorf("invalid compose file")
 	ErrUnknownDeploymentState = fmt.Errorf("unknown deployment state")
 	ErrImagePullBackoff       = fmt.Errorf("image pull backoff")
+	ErrNoKnownGoodRevision    = fmt.Errorf("no known good revision")
+	ErrUnpinnedImage          = fmt.Errorf("unpinned image")
 )
 
 type DeploymentState int
@@ -27,15 +34,59 @@ const (
 	Removed
 	Updated
 	Unchanged
+	RolledBack
+	Unhealthy
+	Stopped
 )
 
+func (s DeploymentState) String() string {
+	switch s {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Updated:
+		return "updated"
+	case Unchanged:
+		return "unchanged"
+	case RolledBack:
+		return "rolled_back"
+	case Unhealthy:
+		return "unhealthy"
+	case Stopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
 type Deployment struct {
 	docker   docker.Docker
 	Filepath string
+	Commit   string
 	compose  compose.ComposeFile
 	State    DeploymentState
 	config   DeploymentConfig
+	project  *types.Project
+	files    []string
+	current  *snapshot
+	previous *snapshot
+	Drift    []compose.ServiceDrift
 	Error    error
+
+	// Only the images changed, see MarkImagesUpdated
+	imagesUpdated bool
+
+	// See SetPathAlias
+	aliasRoot string
+	alias     string
+}
+
+// Revision is a version of a stack that was started successfully
+type Revision struct {
+	Commit  string
+	Hash    string
+	project *types.Project
 }
 
 type DeploymentConfig struct {
@@ -45,8 +96,8 @@ type DeploymentConfig struct {
 	gitopsController bool
 }
 
-func NewDeployment(docker *docker.Docker, filepath string) *Deployment {
-	c := compose.NewComposeFile(filepath)
+func NewDeployment(docker *docker.Docker, filepath string, composeOptions ...compose.ComposeFileOption) *Deployment {
+	c := compose.NewComposeFile(filepath, composeOptions...)
 
 	return &Deployment{
 		docker:   *docker,
@@ -58,6 +109,21 @@ func NewDeployment(docker *docker.Docker, filepath string) *Deployment {
 	}
 }
 
+// SetPathAlias makes a stack loaded from a copy of the repository (below
+// root) comparable with the checked out stack (below alias). Paths are hashed
+// and compose files are reported as if the stack was loaded from alias.
+func (d *Deployment) SetPathAlias(root, alias string) {
+	d.aliasRoot = root
+	d.alias = alias
+}
+
+func (d *Deployment) aliased(path string) string {
+	if d.aliasRoot == "" {
+		return path
+	}
+	return strings.ReplaceAll(path, d.aliasRoot, d.alias)
+}
+
 func (d *Deployment) LoadConfig() error {
 	oldConfig := d.config
 
@@ -68,6 +134,12 @@ func (d *Deployment) LoadConfig() error {
 		gitopsController: false,
 	}
 
+	oldSnapshot := d.current
+
+	d.project = nil
+	d.files = nil
+	d.current = nil
+
 	project, err := d.compose.LoadProject()
 	if err != nil {
 		return fmt.Errorf("failed to load project from compose file %s: %w", d.Filepath, err)
@@ -94,36 +166,134 @@ func (d *Deployment) LoadConfig() error {
 		slog.Warn("failed to sort compose project yaml, using unsorted version", "err", err)
 		sortedProjectYaml = projectYaml
 	}
+	if d.aliasRoot != "" {
+		sortedProjectYaml = bytes.ReplaceAll(sortedProjectYaml, []byte(d.aliasRoot), []byte(d.alias))
+		for i, filepath := range project.ComposeFiles {
+			project.ComposeFiles[i] = d.aliased(filepath)
+		}
+	}
 
 	hash := sha256.New()
 	hash.Write(sortedProjectYaml)
 
+	// The merged project covers the content of all compose files, adding or
+	// removing an override file must still change the hash
+	for _, filepath := range project.ComposeFiles {
+		hash.Write([]byte(d.aliased(filepath)))
+	}
+
+	// Activated profiles
+	profiles := slices.Clone(project.Profiles)
+	sort.Strings(profiles)
+	hash.Write([]byte(strings.Join(profiles, ",")))
+
 	// Get and sort to ensure a deterministic order
 	watchFiles := d.compose.GetWatchFiles(project)
 	sort.Strings(watchFiles)
 
+	watchHashes := map[string]string{}
 	for _, filepath := range watchFiles {
 		f, err := os.Open(filepath)
 		if err != nil {
 			slog.Warn("failed to open watch file for hashing, skipping", "file", filepath, "err", err)
 			continue
 		}
-		io.Copy(hash, f)
+		fileHash := sha256.New()
+		io.Copy(io.MultiWriter(hash, fileHash), f)
 		f.Close()
+		watchHashes[d.aliased(filepath)] = hex.EncodeToString(fileHash.Sum(nil))
 	}
 
 	d.config.hash = hex.EncodeToString(hash.Sum(nil)[:])
 	d.config.isValid = true
+	d.project = project
+	d.files = append(slices.Clone(project.ComposeFiles), watchFiles...)
+	d.current = &snapshot{
+		yaml:        sortedProjectYaml,
+		watchHashes: watchHashes,
+	}
 
 	if oldConfig != (DeploymentConfig{}) {
 		if oldConfig.hash != d.config.hash {
 			d.State = Updated
+			d.previous = oldSnapshot
 		}
 	}
 
 	return nil
 }
 
+// Revision returns the currently loaded version of the stack.
+func (d *Deployment) Revision() Revision {
+	return Revision{
+		Commit:  d.Commit,
+		Hash:    d.config.hash,
+		project: d.project,
+	}
+}
+
+// Rollback starts a previous revision of the stack after the current one
+// failed. The error of the failed apply is kept. Only the compose project of
+// the revision is restored (images, environment, ports, volumes, labels, ...),
+// files it references from the working tree (e.g. bind mounted config files or
+// build contexts) are those of the failed commit.
+func (d *Deployment) Rollback(r Revision) error {
+	if r.project == nil {
+		return ErrNoKnownGoodRevision
+	}
+	if err := d.startProject(r.project); err != nil {
+		return fmt.Errorf("rollback to %s failed: %w", r.Commit, err)
+	}
+	d.State = RolledBack
+	return nil
+}
+
+// IsAffectedBy reports whether any of the given absolute paths is inside the
+// stack directory or one of its compose or watch files.
+func (d *Deployment) IsAffectedBy(paths []string) bool {
+	directory := filepath.Dir(d.Filepath) + string(filepath.Separator)
+	for _, p := range paths {
+		if strings.HasPrefix(p, directory) || slices.Contains(d.files, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthPolicy returns the wait and timeout policy of the loaded stack
+func (d *Deployment) HealthPolicy() compose.HealthPolicy {
+	if d.project == nil {
+		return compose.HealthPolicy{OnTimeout: compose.TimeoutRollback}
+	}
+	return d.compose.GetHealthPolicy(d.project)
+}
+
+// DependsOn returns the stacks (directories relative to the repository) that
+// have to be applied before this one.
+func (d *Deployment) DependsOn() []string {
+	if d.project == nil {
+		return nil
+	}
+	return d.compose.GetGitopsConfig(d.project).DependsOn
+}
+
+// Files returns the compose, override and watch files of the stack
+func (d *Deployment) Files() []string {
+	return slices.Clone(d.files)
+}
+
+func (d *Deployment) Hash() string {
+	return d.config.hash
+}
+
+func (d *Deployment) Containers() ([]compose.ContainerStatus, error) {
+	return d.compose.Containers()
+}
+
+func (d *Deployment) Status() (compose.ProjectStatus, error) {
+	return d.compose.Status()
+}
+
 func (d *Deployment) IsIgnored() bool {
 	return d.config.gitopsIgnore
 }
@@ -132,6 +302,16 @@ func (d *Deployment) IsController() bool {
 	return d.config.gitopsController
 }
 
+// Stop stops the stack without changing its state (e.g. a manual stop)
+func (d *Deployment) Stop() (bool, error) {
+	wasStopped, err := d.ensureIsStopped()
+	if err != nil {
+		d.Error = err
+		return false, err
+	}
+	return wasStopped, nil
+}
+
 func (d *Deployment) Apply() (bool, error) {
 	// Reset error state before applying changes
 	d.Error = nil
@@ -144,18 +324,22 @@ func (d *Deployment) Apply() (bool, error) {
 		return false, nil
 	}
 	if d.config.gitopsController {
-		// TODO: start temporary container that restarts the controller
+		// Updated through a helper container (see gitops self-update)
 		return false, nil
 	}
 	switch d.State {
 	case Added:
 		{
+			if err := d.checkPinning(); err != nil {
+				d.Error = err
+				return false, err
+			}
 			if err := d.prepareImages(); err != nil {
 				slog.Error("failed to prepare images for updated deployment", "file", d.Filepath, "err", err)
 				d.Error = ErrImagePullBackoff
 				return false, ErrImagePullBackoff
 			}
-			if err := d.compose.Start(); err != nil {
+			if err := d.start(); err != nil {
 				d.Error = err
 				return false, err
 			}
@@ -172,21 +356,32 @@ func (d *Deployment) Apply() (bool, error) {
 		}
 	case Updated:
 		{
+			if err := d.checkPinning(); err != nil {
+				d.Error = err
+				return false, err
+			}
 			if err := d.prepareImages(); err != nil {
 				d.Error = err
 				return false, err
 			}
-			_, err := d.ensureIsStopped()
-			if err != nil {
+			if d.imagesUpdated {
+				if err := d.startServices(nil); err != nil {
+					d.Error = err
+					return false, err
+				}
+				return true, nil
+			}
+			// Always redeploy, the old containers could count as complete
+			// (e.g. exited one-shot containers)
+			if err := d.compose.Stop(); err != nil {
 				d.Error = err
 				return false, err
 			}
-			wasStarted, err := d.ensureIsRunning()
-			if err != nil {
+			if err := d.start(); err != nil {
 				d.Error = err
 				return false, err
 			}
-			return wasStarted, nil
+			return true, nil
 		}
 	case Unchanged:
 		{
@@ -199,13 +394,172 @@ func (d *Deployment) Apply() (bool, error) {
 				d.Error = err
 				return false, err
 			}
-			return wasStarted, nil
+			if wasStarted {
+				return true, nil
+			}
+			wasCorrected, err := d.checkDrift()
+			if err != nil {
+				d.Error = err
+				return false, err
+			}
+			return wasCorrected, nil
 		}
 	}
 	d.Error = ErrUnknownDeploymentState
 	return false, ErrUnknownDeploymentState
 }
 
+func (d *Deployment) ImageUpdatesEnabled() bool {
+	return d.project != nil && d.compose.ImageUpdatesEnabled(d.project)
+}
+
+// UpdatedImages returns the images whose registry digest differs from the
+// local image. Images pinned by digest are skipped.
+func (d *Deployment) UpdatedImages() ([]string, error) {
+	images, err := d.compose.ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	updated := []string{}
+	for _, image := range images {
+		if image == "" || strings.Contains(image, "@") || slices.Contains(updated, image) {
+			continue
+		}
+		hasUpdate, digest, err := d.docker.HasNewerDigest(image)
+		if err != nil {
+			return nil, err
+		}
+		if hasUpdate {
+			slog.Info("image update available", "file", d.Filepath, "image", image, "digest", digest)
+			updated = append(updated, image)
+		}
+	}
+
+	return updated, nil
+}
+
+// PullUpdatedImages pulls the given images although they exist locally
+func (d *Deployment) PullUpdatedImages(images []string) error {
+	for _, image := range images {
+		if err := d.docker.ForcePull(image); err != nil {
+			slog.Error("failed to pull image", "image", image, "err", err)
+			return ErrImagePullBackoff
+		}
+	}
+	return nil
+}
+
+// MarkImagesUpdated updates the stack without stopping it. Only the
+// containers of services with a new image are recreated.
+func (d *Deployment) MarkImagesUpdated() {
+	d.State = Updated
+	d.imagesUpdated = true
+}
+
+// checkPinning warns about or refuses stacks with unpinned images
+func (d *Deployment) checkPinning() error {
+	if d.project == nil {
+		return nil
+	}
+
+	policy := d.compose.GetPinningPolicy(d.project)
+	if policy == compose.PinningOff {
+		return nil
+	}
+
+	unpinned := d.compose.UnpinnedImages(d.project)
+	if len(unpinned) == 0 {
+		return nil
+	}
+	if policy == compose.PinningEnforce {
+		return fmt.Errorf("%w: %s", ErrUnpinnedImage, strings.Join(unpinned, ", "))
+	}
+	slog.Warn("deployment uses unpinned images", "file", d.Filepath, "images", unpinned)
+	return nil
+}
+
+// ImageReport is the image a container of the stack actually runs
+type ImageReport struct {
+	Service   string `json:"service"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	ImageID   string `json:"imageId"`
+	Digest    string `json:"digest,omitempty"`
+	Pinned    bool   `json:"pinned"`
+}
+
+func (d *Deployment) Images() ([]ImageReport, error) {
+	status, err := d.compose.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []ImageReport{}
+	for _, service := range status.Services {
+		for _, container := range service.Containers {
+			imageID, digest, err := d.docker.ContainerImage(container.ID)
+			if err != nil {
+				slog.Warn("failed to resolve image digest", "file", d.Filepath, "container", container.Name, "err", err)
+			}
+			reports = append(reports, ImageReport{
+				Service:   service.Service,
+				Container: container.Name,
+				Image:     container.Image,
+				ImageID:   imageID,
+				Digest:    digest,
+				Pinned:    compose.IsPinned(container.Image),
+			})
+		}
+	}
+
+	return reports, nil
+}
+
+// PrepareControllerUpdate pulls the images of the updated controller stack and
+// tags the running images for a rollback. Returns the rollback image per
+// service.
+func (d *Deployment) PrepareControllerUpdate() (map[string]string, error) {
+	if d.project == nil {
+		return nil, ErrInvalidComposeFile
+	}
+	if err := d.prepareImages(); err != nil {
+		return nil, err
+	}
+
+	status, err := d.compose.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	images := map[string]string{}
+	for _, service := range status.Services {
+		if len(service.Containers) == 0 {
+			continue
+		}
+		imageID, _, err := d.docker.ContainerImage(service.Containers[0].ID)
+		if err != nil {
+			return nil, err
+		}
+		rollbackImage := fmt.Sprintf("gitops-rollback/%s:%s", d.project.Name, service.Service)
+		if err := d.docker.TagImage(imageID, rollbackImage); err != nil {
+			return nil, err
+		}
+		images[service.Service] = rollbackImage
+	}
+
+	return images, nil
+}
+
+// ServiceHashes returns the compose config hash of each service, containers
+// created from the loaded stack are labeled with it
+func (d *Deployment) ServiceHashes() (map[string]string, error) {
+	if d.project == nil {
+		return nil, ErrInvalidComposeFile
+	}
+	return compose.ServiceHashes(d.project)
+}
+
 func (d *Deployment) prepareImages() error {
 	images, err := d.compose.ListImages()
 	if err != nil {
@@ -223,6 +577,54 @@ func (d *Deployment) prepareImages() error {
 	return nil
 }
 
+func (d *Deployment) start() error {
+	project, err := d.compose.LoadProject()
+	if err != nil {
+		return err
+	}
+	return d.startProject(project)
+}
+
+// startProject creates missing external networks and volumes (if enabled)
+// before starting the project.
+func (d *Deployment) startProject(project *types.Project) error {
+	if err := d.ensureExternalResources(project); err != nil {
+		return err
+	}
+	return d.compose.StartProject(project)
+}
+
+// startServices starts the given services (all if empty) and only recreates
+// containers that diverge from the compose files.
+func (d *Deployment) startServices(services []string) error {
+	project, err := d.compose.LoadProject()
+	if err != nil {
+		return err
+	}
+	if err := d.ensureExternalResources(project); err != nil {
+		return err
+	}
+	return d.compose.StartServices(project, services)
+}
+
+func (d *Deployment) ensureExternalResources(project *types.Project) error {
+	if !d.compose.CreateExternalEnabled(project) {
+		return nil
+	}
+	networks, volumes := compose.ExternalResources(project)
+	for _, network := range networks {
+		if _, err := d.docker.EnsureNetwork(network); err != nil {
+			return err
+		}
+	}
+	for _, volume := range volumes {
+		if _, err := d.docker.EnsureVolume(volume); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Deployment) ensureIsStopped() (bool, error) {
 	isRunning, err := d.compose.IsRunning()
 	if err != nil {
@@ -237,15 +639,61 @@ func (d *Deployment) ensureIsStopped() (bool, error) {
 	return false, nil
 }
 
+// checkDrift compares the running containers with the desired project and
+// recreates the drifted services if the drift policy of the stack is set to
+// correct.
+func (d *Deployment) checkDrift() (bool, error) {
+	d.Drift = nil
+
+	policy, err := d.compose.GetDriftPolicy()
+	if err != nil {
+		return false, err
+	}
+	if policy == compose.DriftIgnore {
+		return false, nil
+	}
+
+	drift, err := d.compose.DetectDrift()
+	if err != nil {
+		return false, err
+	}
+	if len(drift) == 0 {
+		return false, nil
+	}
+	d.Drift = drift
+
+	if policy != compose.DriftCorrect {
+		return false, nil
+	}
+	services := []string{}
+	for _, s := range drift {
+		services = append(services, s.Service)
+	}
+	if err := d.startServices(services); err != nil {
+		return false, fmt.Errorf("failed to correct drift: %w", err)
+	}
+	return true, nil
+}
+
 func (d *Deployment) ensureIsRunning() (bool, error) {
-	isRunning, err := d.compose.IsRunning()
+	status, err := d.compose.Status()
 	if err != nil {
 		return false, err
 	}
-	if isRunning {
+	if status.IsComplete() {
 		return false, nil
 	}
-	if err := d.compose.Start(); err != nil {
+	if !status.IsRunning() {
+		if err := d.start(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	// Only start the missing services, the others keep running
+	incomplete := status.Incomplete()
+	slog.Warn("deployment is only partially running, starting missing services", "file", d.Filepath, "services", incomplete)
+	if err := d.startServices(incomplete); err != nil {
 		return false, err
 	}
 	return true, nil
@@ -0,0 +1,268 @@
+package deployment
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// snapshot is the normalized content of a loaded stack version
+type snapshot struct {
+	yaml        []byte
+	watchHashes map[string]string
+}
+
+type ValueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type ListChange struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// EnvChange only names the changed key, interpolated values may contain
+// credentials (e.g. in urls) and are never exposed
+type EnvChange struct {
+	Key    string `json:"key"`
+	Change string `json:"change"`
+}
+
+type ServiceDiff struct {
+	Name        string       `json:"name"`
+	Change      string       `json:"change"`
+	Image       *ValueChange `json:"image,omitempty"`
+	Environment []EnvChange  `json:"environment,omitempty"`
+	Ports       *ListChange  `json:"ports,omitempty"`
+	Volumes     *ListChange  `json:"volumes,omitempty"`
+}
+
+// Diff describes the changes between the previous and the current version of
+// a stack. Environment values are not included.
+type Diff struct {
+	Services     []ServiceDiff `json:"services,omitempty"`
+	WatchedFiles []string      `json:"watchedFiles,omitempty"`
+}
+
+func (d Diff) IsEmpty() bool {
+	return len(d.Services) == 0 && len(d.WatchedFiles) == 0
+}
+
+// String returns a one-line summary for logs
+func (d Diff) String() string {
+	return strings.Join(d.Summary(), "; ")
+}
+
+// Summary describes each changed service and the changed watch files
+func (d Diff) Summary() []string {
+	parts := []string{}
+	for _, s := range d.Services {
+		if s.Change != "changed" {
+			parts = append(parts, fmt.Sprintf("%s %s", s.Change, s.Name))
+			continue
+		}
+		details := []string{}
+		if s.Image != nil {
+			details = append(details, fmt.Sprintf("image %s -> %s", s.Image.From, s.Image.To))
+		}
+		for _, e := range s.Environment {
+			details = append(details, fmt.Sprintf("env %s %s", e.Change, e.Key))
+		}
+		if s.Ports != nil {
+			details = append(details, fmt.Sprintf("ports +%v -%v", s.Ports.Added, s.Ports.Removed))
+		}
+		if s.Volumes != nil {
+			details = append(details, fmt.Sprintf("volumes +%v -%v", s.Volumes.Added, s.Volumes.Removed))
+		}
+		if len(details) == 0 {
+			details = append(details, "config")
+		}
+		parts = append(parts, fmt.Sprintf("changed %s (%s)", s.Name, strings.Join(details, ", ")))
+	}
+	if len(d.WatchedFiles) > 0 {
+		parts = append(parts, fmt.Sprintf("watched files %v", d.WatchedFiles))
+	}
+	return parts
+}
+
+// Diff compares the current version of the stack with the version loaded
+// before (e.g. before the git pull). It is empty if there is no previous
+// version.
+func (d *Deployment) Diff() (Diff, error) {
+	return diffSnapshots(d.previous, d.current)
+}
+
+// DiffFrom compares the stack with another loaded version of it (e.g. the
+// checked out version with the one of a remote commit).
+func (d *Deployment) DiffFrom(previous *Deployment) (Diff, error) {
+	return diffSnapshots(previous.current, d.current)
+}
+
+func diffSnapshots(previous, current *snapshot) (Diff, error) {
+	diff := Diff{}
+	if previous == nil || current == nil {
+		return diff, nil
+	}
+
+	oldServices, err := parseServices(previous.yaml)
+	if err != nil {
+		return diff, err
+	}
+	newServices, err := parseServices(current.yaml)
+	if err != nil {
+		return diff, err
+	}
+
+	names := []string{}
+	for name := range oldServices {
+		names = append(names, name)
+	}
+	for name := range newServices {
+		if _, ok := oldServices[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldService, hadService := oldServices[name]
+		newService, hasService := newServices[name]
+		switch {
+		case !hadService:
+			diff.Services = append(diff.Services, ServiceDiff{Name: name, Change: "added"})
+		case !hasService:
+			diff.Services = append(diff.Services, ServiceDiff{Name: name, Change: "removed"})
+		case !reflect.DeepEqual(oldService, newService):
+			diff.Services = append(diff.Services, diffService(name, oldService, newService))
+		}
+	}
+
+	for file, hash := range current.watchHashes {
+		if previous.watchHashes[file] != hash {
+			diff.WatchedFiles = append(diff.WatchedFiles, file)
+		}
+	}
+	for file := range previous.watchHashes {
+		if _, ok := current.watchHashes[file]; !ok {
+			diff.WatchedFiles = append(diff.WatchedFiles, file)
+		}
+	}
+	sort.Strings(diff.WatchedFiles)
+
+	return diff, nil
+}
+
+func parseServices(projectYaml []byte) (map[string]map[string]any, error) {
+	var project struct {
+		Services map[string]map[string]any `yaml:"services"`
+	}
+	if err := yaml.Unmarshal(projectYaml, &project); err != nil {
+		return nil, fmt.Errorf("failed to parse project yaml: %w", err)
+	}
+	return project.Services, nil
+}
+
+func diffService(name string, oldService, newService map[string]any) ServiceDiff {
+	diff := ServiceDiff{Name: name, Change: "changed"}
+
+	oldImage, newImage := fmt.Sprint(oldService["image"]), fmt.Sprint(newService["image"])
+	if oldImage != newImage {
+		diff.Image = &ValueChange{From: oldImage, To: newImage}
+	}
+
+	diff.Environment = diffEnvironment(asMap(oldService["environment"]), asMap(newService["environment"]))
+	diff.Ports = diffList(renderList(oldService["ports"], renderPort), renderList(newService["ports"], renderPort))
+	diff.Volumes = diffList(renderList(oldService["volumes"], renderVolume), renderList(newService["volumes"], renderVolume))
+
+	return diff
+}
+
+func asMap(value any) map[string]any {
+	if m, ok := value.(map[string]any); ok {
+		return m
+	}
+	return map[string]any{}
+}
+
+func diffEnvironment(oldEnv, newEnv map[string]any) []EnvChange {
+	changes := []EnvChange{}
+	for key, value := range newEnv {
+		oldValue, ok := oldEnv[key]
+		switch {
+		case !ok:
+			changes = append(changes, EnvChange{Key: key, Change: "added"})
+		case !reflect.DeepEqual(oldValue, value):
+			changes = append(changes, EnvChange{Key: key, Change: "changed"})
+		}
+	}
+	for key := range oldEnv {
+		if _, ok := newEnv[key]; !ok {
+			changes = append(changes, EnvChange{Key: key, Change: "removed"})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+func renderList(value any, render func(map[string]any) string) []string {
+	items := []string{}
+	list, _ := value.([]any)
+	for _, item := range list {
+		if m, ok := item.(map[string]any); ok {
+			items = append(items, render(m))
+		} else {
+			items = append(items, fmt.Sprint(item))
+		}
+	}
+	return items
+}
+
+func renderPort(port map[string]any) string {
+	rendered := fmt.Sprint(port["target"])
+	if published, ok := port["published"]; ok {
+		rendered = fmt.Sprintf("%v:%s", published, rendered)
+	}
+	if protocol, ok := port["protocol"]; ok {
+		rendered = fmt.Sprintf("%s/%v", rendered, protocol)
+	}
+	return rendered
+}
+
+func renderVolume(volume map[string]any) string {
+	rendered := fmt.Sprint(volume["target"])
+	if source, ok := volume["source"]; ok {
+		rendered = fmt.Sprintf("%v:%s", source, rendered)
+	}
+	if readOnly, ok := volume["read_only"].(bool); ok && readOnly {
+		rendered += ":ro"
+	}
+	return rendered
+}
+
+func diffList(oldItems, newItems []string) *ListChange {
+	change := ListChange{}
+	for _, item := range newItems {
+		if !slices.Contains(oldItems, item) {
+			change.Added = append(change.Added, item)
+		}
+	}
+	for _, item := range oldItems {
+		if !slices.Contains(newItems, item) {
+			change.Removed = append(change.Removed, item)
+		}
+	}
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return nil
+	}
+	return &change
+}
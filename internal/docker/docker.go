@@ -140,6 +140,39 @@ func ImageExistsLocally(cli *client.Client, image string) (bool, error) {
 	return true, nil
 }
 
+// withRegistryAuth runs fn with the credentials of all matching registries
+// and finally without credentials until one attempt succeeds.
+func (d Docker) withRegistryAuth(imageName string, fn func(encodedAuth string) error) error {
+	registries := filterRegistyCredentials(d.registries, imageName)
+	for _, r := range registries {
+		encodedAuthConfig, err := registry.EncodeAuthConfig(registry.AuthConfig{
+			Username:      r.Username,
+			Password:      r.Password,
+			ServerAddress: r.Url,
+		})
+
+		if err != nil {
+			slog.Warn("failed to encode registry auth config", "registry", r.Url, "error", err)
+			continue
+		}
+
+		if err := fn(encodedAuthConfig); err != nil {
+			slog.Warn("registry request with credentials failed", "registry", r.Url, "image", imageName, "error", err)
+			continue
+		}
+
+		return nil
+	}
+
+	// Try without registry credentials
+	err := fn("")
+	if err != nil {
+		slog.Warn("registry request without credentials failed", "image", imageName, "error", err)
+		return fmt.Errorf("%s: no valid registry credentials found: %w", imageName, err)
+	}
+	return nil
+}
+
 func (d Docker) Pull(imageName string) error {
 	cli, err := d.getClient()
 	if err != nil {
@@ -157,41 +190,97 @@ func (d Docker) Pull(imageName string) error {
 		return nil
 	}
 
-	// Try pulling with registry credentials
+	return d.pull(cli, imageName)
+}
+
+// ForcePull pulls the image even if it exists locally (e.g. a moved tag)
+func (d Docker) ForcePull(imageName string) error {
+	cli, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	return d.pull(cli, imageName)
+}
+
+func (d Docker) pull(cli *client.Client, imageName string) error {
 	slog.Info("pulling image", "name", imageName)
-	registries := filterRegistyCredentials(d.registries, imageName)
-	for _, r := range registries {
-		encodedAuthConfig, err := registry.EncodeAuthConfig(registry.AuthConfig{
-			Username:      r.Username,
-			Password:      r.Password,
-			ServerAddress: r.Url,
+	err := d.withRegistryAuth(imageName, func(encodedAuth string) error {
+		return tryPullWithOptions(cli, imageName, image.PullOptions{
+			RegistryAuth: encodedAuth,
 		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %w", err)
+	}
+	return nil
+}
 
-		if err != nil {
-			slog.Warn("failed to encode registry auth config", "registry", r.Url, "error", err)
-			continue
-		}
+// HasNewerDigest compares the registry digest of an image reference with the
+// digests of the local image. Images that do not exist locally are skipped.
+func (d Docker) HasNewerDigest(imageName string) (bool, string, error) {
+	cli, err := d.getClient()
+	if err != nil {
+		return false, "", err
+	}
+	defer cli.Close()
 
-		pullOptions := image.PullOptions{
-			RegistryAuth: encodedAuthConfig,
+	local, err := cli.ImageInspect(context.Background(), imageName)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, "", nil
 		}
+		return false, "", fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+	}
 
-		err = tryPullWithOptions(cli, imageName, pullOptions)
+	var remoteDigest string
+	err = d.withRegistryAuth(imageName, func(encodedAuth string) error {
+		distribution, err := cli.DistributionInspect(context.Background(), imageName, encodedAuth)
 		if err != nil {
-			slog.Warn("failed to pull image with registry credentials", "registry", r.Url, "error", err)
-			continue
+			return err
 		}
-
+		remoteDigest = distribution.Descriptor.Digest.String()
 		return nil
+	})
+	if err != nil {
+		return false, "", fmt.Errorf("failed to get registry digest: %w", err)
 	}
 
-	// Try pulling without registry credentials
-	err = tryPullWithOptions(cli, imageName, image.PullOptions{})
+	for _, repoDigest := range local.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+remoteDigest) {
+			return false, remoteDigest, nil
+		}
+	}
+
+	return true, remoteDigest, nil
+}
+
+// ContainerImage returns the id and registry digest of the image a container
+// runs. The digest is empty for images without repository digest (e.g. built
+// locally).
+func (d Docker) ContainerImage(containerID string) (string, string, error) {
+	cli, err := d.getClient()
 	if err != nil {
-		slog.Warn("failed to pull image without registry credentials", "error", err)
-	} else {
-		return nil
+		return "", "", err
+	}
+	defer cli.Close()
+
+	container, err := cli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+
+	local, err := cli.ImageInspect(context.Background(), container.Image)
+	if err != nil {
+		return container.Image, "", fmt.Errorf("failed to inspect image %s: %w", container.Image, err)
+	}
+
+	for _, repoDigest := range local.RepoDigests {
+		if _, digest, ok := strings.Cut(repoDigest, "@"); ok {
+			return container.Image, digest, nil
+		}
 	}
 
-	return fmt.Errorf("failed to pull image %s: no valid registry credentials found", imageName)
+	return container.Image, "", nil
 }
@@ -0,0 +1,110 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// currentContainerID reads the id of the container this process runs in. The
+// hostname is only a fallback, it can be set by the compose service.
+func currentContainerID() (string, error) {
+	// Mounts of /etc/hostname, /etc/hosts, ... are below /containers/<id>/
+	if content, err := os.ReadFile("/proc/self/mountinfo"); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if _, rest, ok := strings.Cut(line, "/containers/"); ok {
+				if id := containerIDPattern.FindString(rest); id != "" && strings.HasPrefix(rest, id) {
+					return id, nil
+				}
+			}
+		}
+	}
+
+	// cgroup v1
+	if content, err := os.ReadFile("/proc/self/cgroup"); err == nil {
+		if id := containerIDPattern.FindString(string(content)); id != "" {
+			return id, nil
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+	return hostname, nil
+}
+
+// CurrentContainer inspects the container this process runs in
+func (d Docker) CurrentContainer() (container.InspectResponse, error) {
+	cli, err := d.getClient()
+	if err != nil {
+		return container.InspectResponse{}, err
+	}
+	defer cli.Close()
+
+	id, err := currentContainerID()
+	if err != nil {
+		return container.InspectResponse{}, err
+	}
+
+	self, err := cli.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return container.InspectResponse{}, fmt.Errorf("failed to inspect current container: %w", err)
+	}
+	return self, nil
+}
+
+// RunHelper starts a short-lived container from the image of the current
+// container with the same environment and volumes. Returns the container id.
+func (d Docker) RunHelper(name string, cmd []string) (string, error) {
+	self, err := d.CurrentContainer()
+	if err != nil {
+		return "", err
+	}
+
+	cli, err := d.getClient()
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	ctx := context.Background()
+	created, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:  self.Image,
+		Cmd:    cmd,
+		Env:    self.Config.Env,
+		Labels: map[string]string{createdByLabel: "gitops-compose"},
+	}, &container.HostConfig{
+		VolumesFrom: []string{self.ID},
+		AutoRemove:  true,
+	}, nil, nil, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to create helper container: %w", err)
+	}
+
+	if err := cli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		return "", fmt.Errorf("failed to start helper container: %w", err)
+	}
+
+	return created.ID, nil
+}
+
+// TagImage adds a reference to an image (e.g. to keep it for a rollback)
+func (d Docker) TagImage(source, target string) error {
+	cli, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	if err := cli.ImageTag(context.Background(), source, target); err != nil {
+		return fmt.Errorf("failed to tag image %s as %s: %w", source, target, err)
+	}
+	return nil
+}
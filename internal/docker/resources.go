@@ -0,0 +1,81 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// Label of networks and volumes created by gitops-compose
+const createdByLabel = "gitops.created-by"
+
+// Serializes the creation of shared resources by stacks applied in parallel
+var resourcesMu sync.Mutex
+
+// EnsureNetwork creates the network if it does not exist
+func (d Docker) EnsureNetwork(name string) (bool, error) {
+	cli, err := d.getClient()
+	if err != nil {
+		return false, err
+	}
+	defer cli.Close()
+
+	resourcesMu.Lock()
+	defer resourcesMu.Unlock()
+
+	ctx := context.Background()
+	if _, err := cli.NetworkInspect(ctx, name, network.InspectOptions{}); err == nil {
+		return false, nil
+	} else if !client.IsErrNotFound(err) {
+		return false, fmt.Errorf("failed to inspect network %s: %w", name, err)
+	}
+
+	if _, err := cli.NetworkCreate(ctx, name, network.CreateOptions{
+		Labels: map[string]string{createdByLabel: "gitops-compose"},
+	}); errdefs.IsConflict(err) {
+		// Created by someone else in the meantime
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to create network %s: %w", name, err)
+	}
+	slog.Info("created external network", "name", name)
+
+	return true, nil
+}
+
+// EnsureVolume creates the volume if it does not exist
+func (d Docker) EnsureVolume(name string) (bool, error) {
+	cli, err := d.getClient()
+	if err != nil {
+		return false, err
+	}
+	defer cli.Close()
+
+	resourcesMu.Lock()
+	defer resourcesMu.Unlock()
+
+	ctx := context.Background()
+	if _, err := cli.VolumeInspect(ctx, name); err == nil {
+		return false, nil
+	} else if !client.IsErrNotFound(err) {
+		return false, fmt.Errorf("failed to inspect volume %s: %w", name, err)
+	}
+
+	if _, err := cli.VolumeCreate(ctx, volume.CreateOptions{
+		Name:   name,
+		Labels: map[string]string{createdByLabel: "gitops-compose"},
+	}); errdefs.IsConflict(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to create volume %s: %w", name, err)
+	}
+	slog.Info("created external volume", "name", name)
+
+	return true, nil
+}
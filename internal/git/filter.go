@@ -0,0 +1,80 @@
+package git
+
+import (
+	"path"
+	"strings"
+)
+
+// DefaultComposeFilePatterns are the compose file names of the compose spec
+// in order of precedence.
+var DefaultComposeFilePatterns = []string{
+	"compose.yaml",
+	"compose.yml",
+	"docker-compose.yaml",
+	"docker-compose.yml",
+}
+
+type composeFileFilter struct {
+	patterns []string
+	include  []string
+	exclude  []string
+}
+
+func WithComposeFilePatterns(patterns []string) DeploymentRepoOption {
+	return func(r *DeploymentRepo) {
+		if len(patterns) > 0 {
+			r.filter.patterns = patterns
+		}
+	}
+}
+
+// WithPathFilters restricts compose files to paths matching any include glob
+// (all paths when empty) and not matching any exclude glob.
+func WithPathFilters(include, exclude []string) DeploymentRepoOption {
+	return func(r *DeploymentRepo) {
+		r.filter.include = include
+		r.filter.exclude = exclude
+	}
+}
+
+// matchPath matches a glob against the file path and each of its parent
+// directories, so "examples" or "examples/*" exclude everything below it.
+func matchPath(pattern, name string) bool {
+	pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "./"), "/**")
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	for p := name; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// precedence returns the index of the first pattern matching the file name
+// or -1 if it is not a compose file.
+func (f composeFileFilter) precedence(name string) int {
+	filename := path.Base(name)
+	for i, pattern := range f.patterns {
+		if ok, _ := path.Match(pattern, filename); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f composeFileFilter) isIncluded(name string) bool {
+	if len(f.include) > 0 && !matchAny(f.include, name) {
+		return false
+	}
+	return !matchAny(f.exclude, name)
+}
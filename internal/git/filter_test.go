@@ -0,0 +1,37 @@
+package git
+
+import "testing"
+
+func TestComposeFileFilterIsIncluded(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		file    string
+		want    bool
+	}{
+		{"no filters", nil, nil, "app/compose.yaml", true},
+		{"exclude directory", nil, []string{"examples"}, "examples/app/compose.yaml", false},
+		{"exclude directory keeps others", nil, []string{"examples"}, "app/compose.yaml", true},
+		{"exclude directory not a prefix", nil, []string{"examples"}, "examples-old/compose.yaml", true},
+		{"exclude recursive glob", nil, []string{"archive/**"}, "archive/2023/app/compose.yaml", false},
+		{"exclude recursive glob keeps others", nil, []string{"archive/**"}, "apps/archive.yaml", true},
+		{"exclude relative path", nil, []string{"./x"}, "x/compose.yaml", false},
+		{"exclude relative path keeps others", nil, []string{"./x"}, "y/x/compose.yaml", true},
+		{"include directory", []string{"examples"}, nil, "examples/app/compose.yaml", true},
+		{"include directory skips others", []string{"examples"}, nil, "app/compose.yaml", false},
+		{"include recursive glob", []string{"archive/**"}, nil, "archive/app/compose.yaml", true},
+		{"include relative path", []string{"./x"}, nil, "x/compose.yaml", true},
+		{"include relative path skips others", []string{"./x"}, nil, "xy/compose.yaml", false},
+		{"exclude wins over include", []string{"archive/**"}, []string{"archive/old"}, "archive/old/compose.yaml", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := composeFileFilter{include: tt.include, exclude: tt.exclude}
+			if got := f.isIncluded(tt.file); got != tt.want {
+				t.Errorf("isIncluded(%q) = %v, want %v", tt.file, got, tt.want)
+			}
+		})
+	}
+}
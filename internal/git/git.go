@@ -5,22 +5,35 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"strings"
+	"path/filepath"
+	"slices"
 
 	gogit "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	gitHttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 )
 
 var (
 	ErrPathDoesNotExist = fmt.Errorf("path does not exist")
 	ErrHasLocalChanges  = fmt.Errorf("local changes detected")
+	ErrBranchNotFound   = fmt.Errorf("branch not found on remote")
+	ErrNoLocalBranch    = fmt.Errorf("branch not found in the local repository")
+	ErrNonFastForward   = fmt.Errorf("remote history is not a fast-forward of the local branch")
+	ErrGitCliNotFound   = fmt.Errorf("git cli not found")
+	ErrGitCliSkipped    = fmt.Errorf("git cli check skipped with ssh auth")
 )
 
+const defaultBranch = "main"
+
 type DeploymentRepo struct {
-	auth *gitHttp.BasicAuth
-	path string
+	auth   transport.AuthMethod
+	ssh    *sshKeyConfig
+	path   string
+	branch string
+	filter composeFileFilter
 }
 
 type DeploymentRepoOption func(*DeploymentRepo)
@@ -34,6 +47,14 @@ func WithAuth(username, password string) DeploymentRepoOption {
 	}
 }
 
+func WithBranch(branch string) DeploymentRepoOption {
+	return func(r *DeploymentRepo) {
+		if branch != "" {
+			r.branch = branch
+		}
+	}
+}
+
 func NewDeploymentRepo(path string, opts ...DeploymentRepoOption) (*DeploymentRepo, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil, ErrPathDoesNotExist
@@ -60,13 +81,25 @@ func NewDeploymentRepo(path string, opts ...DeploymentRepoOption) (*DeploymentRe
 	}
 
 	repo := &DeploymentRepo{
-		path: path,
+		path:   path,
+		branch: defaultBranch,
+		filter: composeFileFilter{
+			patterns: DefaultComposeFilePatterns,
+		},
 	}
 
 	for _, opt := range opts {
 		opt(repo)
 	}
 
+	if repo.ssh != nil {
+		auth, err := repo.ssh.authMethod(remoteURL)
+		if err != nil {
+			return nil, fmt.Errorf("ssh auth failed: %w", err)
+		}
+		repo.auth = auth
+	}
+
 	return repo, nil
 }
 
@@ -86,71 +119,144 @@ func (r DeploymentRepo) VerifyRemoteAccess() error {
 		listOptions.Auth = r.auth
 	}
 
-	_, err = remote.List(listOptions)
+	refs, err := remote.List(listOptions)
 	if err != nil {
 		return fmt.Errorf("remote is not working or auth failed: %w", err)
 	}
 
+	// Ensure the tracked branch exists on the remote
+	for _, ref := range refs {
+		if ref.Name() == r.localBranchRef() {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrBranchNotFound, r.branch)
+}
+
+// VerifyLocalBranch ensures the tracked branch exists locally (e.g. it is not
+// when REPOSITORY_BRANCH differs from the cloned branch).
+func (r DeploymentRepo) VerifyLocalBranch() error {
+	repo, err := gogit.PlainOpen(r.path)
+	if err != nil {
+		return fmt.Errorf("open repo failed: %w", err)
+	}
+
+	if _, err := repo.Reference(r.localBranchRef(), true); err != nil {
+		return fmt.Errorf("%w: %s (check it out with `git checkout %s` or clone the repository with `--branch %s`)", ErrNoLocalBranch, r.branch, r.branch, r.branch)
+	}
+
+	return nil
+}
+
+func (r DeploymentRepo) Path() string {
+	return r.path
+}
+
+func (r DeploymentRepo) Branch() string {
+	return r.branch
+}
+
+func (r DeploymentRepo) localBranchRef() plumbing.ReferenceName {
+	return plumbing.NewBranchReferenceName(r.branch)
+}
+
+func (r DeploymentRepo) remoteBranchRef() plumbing.ReferenceName {
+	return plumbing.NewRemoteReferenceName("origin", r.branch)
+}
+
+func (r DeploymentRepo) fetch(repo *gogit.Repository) error {
+	err := repo.Fetch(&gogit.FetchOptions{
+		RemoteName: "origin",
+		Auth:       r.auth,
+		Tags:       gogit.NoTags,
+		Force:      false,
+		Prune:      false,
+	})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return fmt.Errorf("fetch failed: %w", err)
+	}
 	return nil
 }
 
-func (r DeploymentRepo) HasChanges() (bool, error) {
+// HasChanges fetches the remote and returns the remote head commit that all
+// further operations of a check should refer to.
+func (r DeploymentRepo) HasChanges() (string, bool, error) {
 	// Open the repository
 	repo, err := gogit.PlainOpen(r.path)
 	if err != nil {
-		return false, fmt.Errorf("open repo failed: %w", err)
+		return "", false, fmt.Errorf("open repo failed: %w", err)
 	}
 
 	// Get the working tree
 	worktree, err := repo.Worktree()
 	if err != nil {
-		return false, fmt.Errorf("get worktree failed: %w", err)
+		return "", false, fmt.Errorf("get worktree failed: %w", err)
 	}
 
 	// Check if the working tree is clean
 	status, err := worktree.Status()
 	if err != nil {
-		return false, fmt.Errorf("get status failed: %w", err)
+		return "", false, fmt.Errorf("get status failed: %w", err)
 	}
 
 	// If there are changes, we cannot savely proceed
 	if !status.IsClean() {
-		return false, ErrHasLocalChanges
+		return "", false, ErrHasLocalChanges
 	}
 
 	// Fetch the latest changes from the remote repository
-	err = repo.Fetch(&gogit.FetchOptions{
-		RemoteName: "origin",
-		Auth:       r.auth,
-		Tags:       gogit.NoTags,
-		Force:      false,
-		Prune:      false,
-	})
-	if err != nil {
-		if err == gogit.NoErrAlreadyUpToDate {
-			return false, nil
-		}
-		return false, fmt.Errorf("fetch failed: %w", err)
+	if err := r.fetch(repo); err != nil {
+		return "", false, err
 	}
 
-	// Get the local references for the main branch
-	localRef, err := repo.Reference(plumbing.ReferenceName("refs/heads/main"), true)
+	// Get the local references for the tracked branch
+	localRef, err := repo.Reference(r.localBranchRef(), true)
 	if err != nil {
-		return false, fmt.Errorf("get local ref failed: %w", err)
+		return "", false, fmt.Errorf("get local ref failed: %w", err)
 	}
 
-	// Get the remote references for the main branch
-	remoteRef, err := repo.Reference(plumbing.ReferenceName("refs/remotes/origin/main"), true)
+	// Get the remote references for the tracked branch
+	remoteRef, err := repo.Reference(r.remoteBranchRef(), true)
 	if err != nil {
-		return false, fmt.Errorf("get remote ref failed: %w", err)
+		return "", false, fmt.Errorf("get remote ref failed: %w", err)
 	}
 
 	// Compare the hashes of the local and remote references
+	target := remoteRef.Hash().String()
 	if localRef.Hash() == remoteRef.Hash() {
-		return false, nil
-	} else {
-		return true, nil
+		return target, false, nil
+	}
+
+	// Refuse the check before anything is applied, Pull could not check out
+	// the target commit
+	if err := checkFastForward(repo, localRef.Hash(), remoteRef.Hash()); err != nil {
+		return "", false, err
+	}
+	return target, true, nil
+}
+
+// checkFastForward returns ErrNonFastForward if the target commit does not
+// descend from the local commit (e.g. after a force-push or a local commit).
+func checkFastForward(repo *gogit.Repository, local, target plumbing.Hash) error {
+	localCommit, err := repo.CommitObject(local)
+	if err != nil {
+		return fmt.Errorf("get local commit failed: %w", err)
+	}
+
+	targetCommit, err := repo.CommitObject(target)
+	if err != nil {
+		return fmt.Errorf("get target commit failed: %w", err)
+	}
+
+	isAncestor, err := localCommit.IsAncestor(targetCommit)
+	if err != nil {
+		return fmt.Errorf("check ancestry failed: %w", err)
 	}
+	if !isAncestor {
+		return fmt.Errorf("%w: local %s, remote %s", ErrNonFastForward, local, target)
+	}
+	return nil
 }
 
 func (r DeploymentRepo) filterComposeFiles(c object.Commit) ([]string, error) {
@@ -160,38 +266,47 @@ func (r DeploymentRepo) filterComposeFiles(c object.Commit) ([]string, error) {
 		return nil, fmt.Errorf("get tree failed: %w", err)
 	}
 
-	// Iterate through the files in the tree
-	var composeFiles []string
+	// Iterate through the files in the tree (one compose file per directory)
+	var directories []string
+	composeFilesByDirectory := map[string]string{}
 	err = tree.Files().ForEach(func(f *object.File) error {
-		filename := path.Base(f.Name)
-		if filename == "docker-compose.yml" {
-			filepath := path.Join(r.path, f.Name)
-			composeFiles = append(composeFiles, filepath)
+		precedence := r.filter.precedence(f.Name)
+		if precedence < 0 || !r.filter.isIncluded(f.Name) {
+			return nil
+		}
+
+		directory := path.Dir(f.Name)
+		existing, ok := composeFilesByDirectory[directory]
+		if !ok {
+			directories = append(directories, directory)
+		} else if r.filter.precedence(existing) <= precedence {
+			return nil
 		}
+		composeFilesByDirectory[directory] = f.Name
 		return nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("walk tree failed: %w", err)
 	}
 
+	var composeFiles []string
+	for _, directory := range directories {
+		filepath := path.Join(r.path, composeFilesByDirectory[directory])
+		composeFiles = append(composeFiles, filepath)
+	}
+
 	return composeFiles, nil
 }
 
-func (r DeploymentRepo) GetRemoteComposeFiles() ([]string, error) {
+func (r DeploymentRepo) GetComposeFiles(commitHash string) ([]string, error) {
 	// Open the repository
 	repo, err := gogit.PlainOpen(r.path)
 	if err != nil {
 		return nil, fmt.Errorf("open repo failed: %w", err)
 	}
 
-	// Get the remote references for the main branch
-	ref, err := repo.Reference(plumbing.ReferenceName("refs/remotes/origin/main"), true)
-	if err != nil {
-		return nil, fmt.Errorf("get remote ref failed: %w", err)
-	}
-
-	// Get the latest commit from the remote main branch
-	commit, err := repo.CommitObject(ref.Hash())
+	// Get the pinned commit
+	commit, err := repo.CommitObject(plumbing.NewHash(commitHash))
 	if err != nil {
 		return nil, fmt.Errorf("get commit object failed: %w", err)
 	}
@@ -206,13 +321,13 @@ func (r DeploymentRepo) GetLocalComposeFiles() ([]string, error) {
 		return nil, fmt.Errorf("open repo failed: %w", err)
 	}
 
-	// Get the local references for the main branch
-	ref, err := repo.Reference(plumbing.ReferenceName("refs/heads/main"), true)
+	// Get the local references for the tracked branch
+	ref, err := repo.Reference(r.localBranchRef(), true)
 	if err != nil {
 		return nil, fmt.Errorf("get local ref failed: %w", err)
 	}
 
-	// Get the latest commit from the local main branch
+	// Get the latest commit from the local tracked branch
 	commit, err := repo.CommitObject(ref.Hash())
 	if err != nil {
 		return nil, fmt.Errorf("get commit object failed: %w", err)
@@ -221,7 +336,118 @@ func (r DeploymentRepo) GetLocalComposeFiles() ([]string, error) {
 	return r.filterComposeFiles(*commit)
 }
 
+func (r DeploymentRepo) GetLocalCommit() (string, error) {
+	// Open the repository
+	repo, err := gogit.PlainOpen(r.path)
+	if err != nil {
+		return "", fmt.Errorf("open repo failed: %w", err)
+	}
+
+	// Get the local references for the tracked branch
+	ref, err := repo.Reference(r.localBranchRef(), true)
+	if err != nil {
+		return "", fmt.Errorf("get local ref failed: %w", err)
+	}
+
+	return ref.Hash().String(), nil
+}
+
+// ChangedFiles returns the paths (relative to the repository) that differ
+// between two commits.
+func (r DeploymentRepo) ChangedFiles(fromHash, toHash string) ([]string, error) {
+	// Open the repository
+	repo, err := gogit.PlainOpen(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("open repo failed: %w", err)
+	}
+
+	trees := []*object.Tree{}
+	for _, hash := range []string{fromHash, toHash} {
+		commit, err := repo.CommitObject(plumbing.NewHash(hash))
+		if err != nil {
+			return nil, fmt.Errorf("get commit object failed: %w", err)
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, fmt.Errorf("get tree failed: %w", err)
+		}
+		trees = append(trees, tree)
+	}
+
+	changes, err := object.DiffTree(trees[0], trees[1])
+	if err != nil {
+		return nil, fmt.Errorf("diff trees failed: %w", err)
+	}
+
+	files := []string{}
+	for _, change := range changes {
+		for _, name := range []string{change.From.Name, change.To.Name} {
+			if name != "" && !slices.Contains(files, name) {
+				files = append(files, name)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// ExportCommit writes the files of a commit to dir without touching the
+// worktree (e.g. to load stacks of a commit that is not checked out).
+func (r DeploymentRepo) ExportCommit(commitHash, dir string) error {
+	// Open the repository
+	repo, err := gogit.PlainOpen(r.path)
+	if err != nil {
+		return fmt.Errorf("open repo failed: %w", err)
+	}
+
+	commit, err := repo.CommitObject(plumbing.NewHash(commitHash))
+	if err != nil {
+		return fmt.Errorf("get commit object failed: %w", err)
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("get tree failed: %w", err)
+	}
+
+	err = tree.Files().ForEach(func(f *object.File) error {
+		target := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+
+		content, err := f.Contents()
+		if err != nil {
+			return err
+		}
+
+		switch f.Mode {
+		case filemode.Symlink:
+			return os.Symlink(content, target)
+		case filemode.Executable:
+			return os.WriteFile(target, []byte(content), 0o755)
+		default:
+			return os.WriteFile(target, []byte(content), 0o644)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("export commit failed: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyGitCli checks the optional git cli (not required for deployments). It
+// is skipped with ssh auth, the key would have to be written to disk for the
+// cli.
 func (r DeploymentRepo) VerifyGitCli() error {
+	if r.ssh != nil {
+		return ErrGitCliSkipped
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return ErrGitCliNotFound
+	}
+
 	cmd := exec.Command("git", "ls-remote")
 	cmd.Dir = r.path
 
@@ -232,18 +458,63 @@ func (r DeploymentRepo) VerifyGitCli() error {
 	return nil
 }
 
-// TODO: Use go-git instead of exec when this issue is resolved (https://github.com/go-git/go-git/pull/1235)
-func (r DeploymentRepo) Pull() error {
-	cmd := exec.Command("git", "pull")
-	cmd.Dir = r.path
+// Pull fast-forwards the tracked branch and worktree to exactly the given
+// commit (as returned by HasChanges).
+func (r DeploymentRepo) Pull(commitHash string) error {
+	// Open the repository
+	repo, err := gogit.PlainOpen(r.path)
+	if err != nil {
+		return fmt.Errorf("open repo failed: %w", err)
+	}
+
+	target := plumbing.NewHash(commitHash)
 
-	output, err := cmd.CombinedOutput()
+	// Get the local references for the tracked branch
+	localRef, err := repo.Reference(r.localBranchRef(), true)
 	if err != nil {
-		outStr := strings.TrimSpace(string(output))
-		if outStr == "Already up to date." || outStr == "Already up-to-date." {
-			return nil
+		return fmt.Errorf("get local ref failed: %w", err)
+	}
+
+	// Only fast-forwards are allowed
+	if err := checkFastForward(repo, localRef.Hash(), target); err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("get worktree failed: %w", err)
+	}
+
+	status, err := worktree.Status()
+	if err != nil {
+		return fmt.Errorf("get status failed: %w", err)
+	}
+	if !status.IsClean() {
+		return ErrHasLocalChanges
+	}
+
+	// Ensure HEAD points to the tracked branch
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("get head failed: %w", err)
+	}
+	if head.Name() != r.localBranchRef() {
+		if err := worktree.Checkout(&gogit.CheckoutOptions{Branch: r.localBranchRef()}); err != nil {
+			return fmt.Errorf("checkout branch failed: %w", err)
 		}
-		return fmt.Errorf("pull failed: %w %s", err, output)
+	}
+
+	// Already at the target commit
+	if localRef.Hash() == target {
+		return nil
+	}
+
+	// Move branch and worktree to the target commit
+	if err := worktree.Reset(&gogit.ResetOptions{
+		Commit: target,
+		Mode:   gogit.HardReset,
+	}); err != nil {
+		return fmt.Errorf("reset worktree failed: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,166 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitFile writes the file to the worktree and commits it on the current
+// branch.
+func commitFile(t *testing.T, repo *gogit.Repository, name, content string) plumbing.Hash {
+	t.Helper()
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worktree.Filesystem.Root(), name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := worktree.Commit("update "+name, &gogit.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// newTestRepos creates a remote repository with an initial commit and a
+// clone of it.
+func newTestRepos(t *testing.T) (*gogit.Repository, *gogit.Repository, *DeploymentRepo) {
+	t.Helper()
+
+	remoteDir := t.TempDir()
+	remote, err := gogit.PlainInitWithOptions(remoteDir, &gogit.PlainInitOptions{
+		InitOptions: gogit.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName(defaultBranch)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, remote, "compose.yaml", "services: {}\n")
+
+	localDir := t.TempDir()
+	local, err := gogit.PlainClone(localDir, false, &gogit.CloneOptions{URL: remoteDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := NewDeploymentRepo(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return remote, local, repo
+}
+
+func head(t *testing.T, repo *gogit.Repository) plumbing.Hash {
+	t.Helper()
+
+	ref, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref.Hash()
+}
+
+func TestPull(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare returns the target commit and the expected local head
+		prepare func(t *testing.T, local *gogit.Repository) (plumbing.Hash, plumbing.Hash)
+		err     error
+	}{
+		{
+			name: "fast-forward",
+			prepare: func(t *testing.T, local *gogit.Repository) (plumbing.Hash, plumbing.Hash) {
+				initial := head(t, local)
+				target := commitFile(t, local, "compose.yaml", "services:\n  app:\n    image: nginx\n")
+				resetTo(t, local, initial)
+				return target, target
+			},
+		},
+		{
+			name: "already at target",
+			prepare: func(t *testing.T, local *gogit.Repository) (plumbing.Hash, plumbing.Hash) {
+				return head(t, local), head(t, local)
+			},
+		},
+		{
+			name: "non-fast-forward",
+			prepare: func(t *testing.T, local *gogit.Repository) (plumbing.Hash, plumbing.Hash) {
+				initial := head(t, local)
+				diverged := commitFile(t, local, "compose.yaml", "services:\n  app:\n    image: nginx\n")
+				resetTo(t, local, initial)
+				current := commitFile(t, local, "compose.yaml", "services:\n  db:\n    image: postgres\n")
+				return diverged, current
+			},
+			err: ErrNonFastForward,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, local, repo := newTestRepos(t)
+			target, want := tt.prepare(t, local)
+
+			err := repo.Pull(target.String())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if got := head(t, local); got != want {
+				t.Errorf("head = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestHasChangesRejectsNonFastForward(t *testing.T) {
+	remote, local, repo := newTestRepos(t)
+	initial := head(t, local)
+
+	// Rewrite the remote branch (force-push)
+	resetTo(t, remote, initial)
+	commitFile(t, remote, "compose.yaml", "services:\n  app:\n    image: nginx\n")
+	commitFile(t, local, "compose.yaml", "services:\n  db:\n    image: postgres\n")
+
+	if _, _, err := repo.HasChanges(); !errors.Is(err, ErrNonFastForward) {
+		t.Fatalf("err = %v, want %v", err, ErrNonFastForward)
+	}
+}
+
+func TestHasChanges(t *testing.T) {
+	remote, _, repo := newTestRepos(t)
+
+	target, hasChanges, err := repo.HasChanges()
+	if err != nil || hasChanges {
+		t.Fatalf("HasChanges() = %s, %v, %v, want no changes", target, hasChanges, err)
+	}
+
+	want := commitFile(t, remote, "compose.yaml", "services:\n  app:\n    image: nginx\n")
+	target, hasChanges, err = repo.HasChanges()
+	if err != nil || !hasChanges || target != want.String() {
+		t.Fatalf("HasChanges() = %s, %v, %v, want %s", target, hasChanges, err, want)
+	}
+}
+
+func resetTo(t *testing.T, repo *gogit.Repository, commit plumbing.Hash) {
+	t.Helper()
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worktree.Reset(&gogit.ResetOptions{Commit: commit, Mode: gogit.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+}
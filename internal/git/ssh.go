@@ -0,0 +1,104 @@
+package git
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitSsh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+const defaultSSHUser = "git"
+
+type sshKeyConfig struct {
+	keyPath        string
+	key            []byte
+	passphrase     string
+	knownHostsPath string
+}
+
+// WithSSHKeyFile authenticates with the private key stored at keyPath. Host
+// keys are always verified against knownHostsPath (or the default known_hosts
+// locations when empty).
+func WithSSHKeyFile(keyPath, passphrase, knownHostsPath string) DeploymentRepoOption {
+	return func(r *DeploymentRepo) {
+		r.ssh = &sshKeyConfig{
+			keyPath:        keyPath,
+			passphrase:     passphrase,
+			knownHostsPath: knownHostsPath,
+		}
+	}
+}
+
+// WithSSHKey works like WithSSHKeyFile but takes the PEM encoded private key
+// directly (e.g. from an environment variable).
+func WithSSHKey(key []byte, passphrase, knownHostsPath string) DeploymentRepoOption {
+	return func(r *DeploymentRepo) {
+		r.ssh = &sshKeyConfig{
+			key:            key,
+			passphrase:     passphrase,
+			knownHostsPath: knownHostsPath,
+		}
+	}
+}
+
+func (c sshKeyConfig) readKey() ([]byte, error) {
+	if c.keyPath == "" {
+		return c.key, nil
+	}
+
+	key, err := os.ReadFile(c.keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read private key failed: %w", err)
+	}
+	return key, nil
+}
+
+func (c sshKeyConfig) knownHostsFiles() []string {
+	if c.knownHostsPath == "" {
+		return []string{}
+	}
+	return []string{c.knownHostsPath}
+}
+
+func (c sshKeyConfig) authMethod(remoteURL string) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(remoteURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse remote url failed: %w", err)
+	}
+
+	if endpoint.Protocol != "ssh" {
+		return nil, fmt.Errorf("ssh key configured but remote url is not an ssh url: %s", remoteURL)
+	}
+
+	user := endpoint.User
+	if user == "" {
+		user = defaultSSHUser
+	}
+
+	key, err := c.readKey()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := gitSsh.NewPublicKeys(user, key, c.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key failed: %w", err)
+	}
+
+	knownHosts, err := gitSsh.NewKnownHostsDb(c.knownHostsFiles()...)
+	if err != nil {
+		return nil, fmt.Errorf("load known hosts failed: %w", err)
+	}
+
+	port := endpoint.Port
+	if port == 0 {
+		port = 22
+	}
+	auth.HostKeyCallback = knownHosts.HostKeyCallback()
+	auth.HostKeyAlgorithms = knownHosts.HostKeyAlgorithms(net.JoinHostPort(endpoint.Host, strconv.Itoa(port)))
+
+	return auth, nil
+}
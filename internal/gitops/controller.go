@@ -0,0 +1,86 @@
+package gitops
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
+	"github.com/korbiniankuhn/gitops-compose/internal/metrics"
+	"github.com/korbiniankuhn/gitops-compose/internal/selfupdate"
+)
+
+// WithSelfUpdate enables updates of the controller stack. The handshake with
+// the helper container is stored in the state directory.
+func WithSelfUpdate(stateDirectory string) GitOpsOption {
+	return func(g *GitOps) {
+		g.selfUpdateDirectory = stateDirectory
+	}
+}
+
+// updateController launches a helper container that runs compose up for the
+// updated controller stack (which replaces this process). The new controller
+// confirms its start, otherwise the helper restarts the previous images.
+func (g *GitOps) updateController(d *deployment.Deployment, state *metrics.DeploymentState) {
+	if g.selfUpdateDirectory == "" {
+		slog.Error("controller self-update requires running in docker (not docker desktop) with a state directory", "file", d.Filepath)
+		state.Failed++
+		return
+	}
+
+	previous, err := selfupdate.Read(g.selfUpdateDirectory)
+	if err != nil {
+		slog.Error("error reading controller update handshake", "err", err)
+		state.Failed++
+		return
+	}
+	if previous != nil && previous.RolledBackAt != nil && previous.Hash == d.Hash() {
+		slog.Error("skipping controller update that was rolled back before", "file", d.Filepath, "commit", previous.Commit)
+		state.Failed++
+		return
+	}
+
+	rollbackImages, err := d.PrepareControllerUpdate()
+	if err != nil {
+		slog.Error("error preparing controller update", "file", d.Filepath, "err", err)
+		state.Failed++
+		return
+	}
+
+	serviceHashes, err := d.ServiceHashes()
+	if err != nil {
+		slog.Error("error preparing controller update", "file", d.Filepath, "err", err)
+		state.Failed++
+		return
+	}
+
+	h := &selfupdate.Handshake{
+		ID:             fmt.Sprint(time.Now().UnixNano()),
+		File:           d.Filepath,
+		Commit:         d.Commit,
+		Hash:           d.Hash(),
+		ServiceHashes:  serviceHashes,
+		RollbackImages: rollbackImages,
+		RequestedAt:    time.Now(),
+	}
+	if err := selfupdate.Write(g.selfUpdateDirectory, h); err != nil {
+		slog.Error("error writing controller update handshake", "err", err)
+		state.Failed++
+		return
+	}
+
+	// The helper replaces this process, persist the state first
+	if err := g.store.Save(); err != nil {
+		slog.Error("error saving state", "err", err)
+	}
+
+	id, err := g.docker.RunHelper("gitops-compose-self-update-"+h.ID, []string{"self-update", "--file", d.Filepath})
+	if err != nil {
+		slog.Error("error starting controller update helper", "file", d.Filepath, "err", err)
+		state.Failed++
+		return
+	}
+
+	state.Updated++
+	slog.Info("started controller update helper", "file", d.Filepath, "commit", d.Commit, "container", id)
+}
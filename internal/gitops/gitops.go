@@ -1,31 +1,82 @@
 package gitops
 
 import (
+	"errors"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"slices"
+	"sync"
 
+	"github.com/korbiniankuhn/gitops-compose/internal/compose"
 	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
 	"github.com/korbiniankuhn/gitops-compose/internal/docker"
 	"github.com/korbiniankuhn/gitops-compose/internal/git"
 	"github.com/korbiniankuhn/gitops-compose/internal/metrics"
+	"github.com/korbiniankuhn/gitops-compose/internal/store"
 )
 
 type GitOps struct {
-	repo             *git.DeploymentRepo
-	docker           *docker.Docker
-	metrics          *metrics.Metrics
-	retryDeployments []*deployment.Deployment
-	isFirstCheck     bool
+	repo                *git.DeploymentRepo
+	docker              *docker.Docker
+	metrics             *metrics.Metrics
+	composeOptions      []compose.ComposeFileOption
+	retryDeployments    []*deployment.Deployment
+	isFirstCheck        bool
+	deployedCommit      string
+	knownGood           map[string]deployment.Revision
+	knownGoodMu         sync.Mutex
+	concurrency         int
+	selfUpdateDirectory string
+	store               *store.Store
+	mu                  sync.RWMutex
+	deployments         []deploymentEntry
 }
 
-func NewGitOps(repo *git.DeploymentRepo, docker *docker.Docker, metrics *metrics.Metrics) *GitOps {
-	return &GitOps{
+type GitOpsOption func(*GitOps)
+
+func WithComposeOptions(opts ...compose.ComposeFileOption) GitOpsOption {
+	return func(g *GitOps) {
+		g.composeOptions = append(g.composeOptions, opts...)
+	}
+}
+
+// WithConcurrency sets the number of stacks that are applied in parallel
+func WithConcurrency(n int) GitOpsOption {
+	return func(g *GitOps) {
+		if n > 0 {
+			g.concurrency = n
+		}
+	}
+}
+
+func WithStore(s *store.Store) GitOpsOption {
+	return func(g *GitOps) {
+		g.store = s
+	}
+}
+
+func NewGitOps(repo *git.DeploymentRepo, docker *docker.Docker, metrics *metrics.Metrics, opts ...GitOpsOption) *GitOps {
+	g := &GitOps{
 		repo:             repo,
 		docker:           docker,
 		metrics:          metrics,
+		composeOptions:   []compose.ComposeFileOption{},
 		retryDeployments: []*deployment.Deployment{},
 		isFirstCheck:     true,
+		knownGood:        map[string]deployment.Revision{},
+		concurrency:      1,
+	}
+
+	for _, opt := range opts {
+		opt(g)
+	}
+
+	if g.store == nil {
+		g.store, _ = store.NewStore("")
 	}
+
+	return g
 }
 
 func (g *GitOps) applyDeploymentChange(d *deployment.Deployment, state *metrics.DeploymentState) {
@@ -47,18 +98,38 @@ func (g *GitOps) applyDeploymentChange(d *deployment.Deployment, state *metrics.
 
 	if err == deployment.ErrInvalidComposeFile {
 		state.Invalid++
+		g.store.RecordError(d.Filepath, err)
 		slog.Error("invalid compose file", "file", d.Filepath)
 		return
+	} else if errors.Is(err, compose.ErrUnhealthy) {
+		g.applyUnhealthy(d, state)
+		return
 	} else if err != nil {
-		state.Failed++
 		if d.State == deployment.Unchanged {
 			slog.Error("error checking unchanged deployment", "file", d.Filepath, "err", err)
 		} else {
 			slog.Error("error applying deployment change", "file", d.Filepath, "operation", operation, "err", err)
 		}
+		g.store.RecordError(d.Filepath, err)
+		if g.rollback(d) {
+			state.RolledBack++
+		} else {
+			state.Failed++
+		}
 		return
 	}
 
+	// Remember the last successfully started version of each stack
+	g.knownGoodMu.Lock()
+	if d.State == deployment.Removed {
+		delete(g.knownGood, d.Filepath)
+		g.store.Remove(d.Filepath)
+	} else {
+		g.knownGood[d.Filepath] = d.Revision()
+		g.store.RecordApplied(d.Filepath, d.Commit, d.Hash())
+	}
+	g.knownGoodMu.Unlock()
+
 	switch d.State {
 	case deployment.Added:
 		if wasChanged {
@@ -73,6 +144,7 @@ func (g *GitOps) applyDeploymentChange(d *deployment.Deployment, state *metrics.
 		if wasChanged {
 			state.Updated++
 			slog.Info("updated deployment", "file", d.Filepath)
+			logDiff(d)
 		} else {
 			// Should never happen
 			state.Unchanged++
@@ -87,24 +159,233 @@ func (g *GitOps) applyDeploymentChange(d *deployment.Deployment, state *metrics.
 			slog.Warn("removed deployment was not running", "file", d.Filepath)
 		}
 	case deployment.Unchanged:
-		if wasChanged {
+		if wasChanged && len(d.Drift) > 0 {
+			state.Updated++
+			slog.Warn("corrected drifted deployment", "file", d.Filepath, "services", driftedServices(d.Drift))
+		} else if wasChanged {
 			state.Started++
 			slog.Warn("started unchanged but not running deployment", "file", d.Filepath)
+		} else if len(d.Drift) > 0 {
+			state.Drifted++
+			slog.Warn("deployment drifted from git", "file", d.Filepath, "services", driftedServices(d.Drift))
 		} else {
 			state.Unchanged++
 		}
 	}
 }
 
-func (g *GitOps) checkAndUpdateDeployments(state *metrics.DeploymentState) ([]*deployment.Deployment, error) {
-	// Get local and remote compose files
+// applyDeploymentChanges applies the deployments with a bounded number of
+// workers. Each worker counts into its own state which is merged afterwards.
+func (g *GitOps) applyDeploymentChanges(deployments []*deployment.Deployment, state *metrics.DeploymentState) {
+	if g.concurrency <= 1 || len(deployments) <= 1 {
+		for _, d := range deployments {
+			g.applyDeploymentChange(d, state)
+		}
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	workers := make(chan struct{}, g.concurrency)
+	for _, d := range deployments {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			local := metrics.NewState()
+			g.applyDeploymentChange(d, local)
+			state.Merge(local)
+		}()
+	}
+	wg.Wait()
+}
+
+// applyUnhealthy handles a stack that did not become healthy in time
+// according to its health policy.
+func (g *GitOps) applyUnhealthy(d *deployment.Deployment, state *metrics.DeploymentState) {
+	policy := d.HealthPolicy().OnTimeout
+	slog.Error("deployment did not become healthy", "file", d.Filepath, "policy", policy, "err", d.Error)
+
+	switch policy {
+	case compose.TimeoutRollback:
+		g.store.RecordError(d.Filepath, d.Error)
+		if g.rollback(d) {
+			state.RolledBack++
+			return
+		}
+	case compose.TimeoutFail:
+		g.store.RecordError(d.Filepath, d.Error)
+		// Do not leave a new version running that never became healthy
+		if d.State == deployment.Added || d.State == deployment.Updated {
+			err := d.Error
+			if _, stopErr := d.Stop(); stopErr != nil {
+				slog.Error("error stopping unhealthy deployment", "file", d.Filepath, "err", stopErr)
+			} else {
+				slog.Warn("stopped unhealthy deployment", "file", d.Filepath)
+				d.Error = err
+			}
+		}
+	case compose.TimeoutKeep:
+		// The stack keeps running, it is applied but not known good
+		g.store.RecordApplied(d.Filepath, d.Commit, d.Hash())
+		g.store.RecordError(d.Filepath, d.Error)
+		slog.Warn("leaving unhealthy deployment running", "file", d.Filepath)
+	}
+	d.State = deployment.Unhealthy
+	state.Unhealthy++
+}
+
+// isManuallyStopped reports whether the stack was stopped through the api, it
+// is left alone until it is synced or restarted.
+func (g *GitOps) isManuallyStopped(d *deployment.Deployment) bool {
+	stack, ok := g.store.Get(d.Filepath)
+	return ok && stack.Stopped
+}
+
+func (g *GitOps) skipManuallyStopped(d *deployment.Deployment, state *metrics.DeploymentState) {
+	if d.State != deployment.Unchanged {
+		slog.Warn("skipping changed deployment, it was stopped manually", "file", d.Filepath)
+	} else {
+		slog.Debug("skipping manually stopped deployment", "file", d.Filepath)
+	}
+	d.State = deployment.Stopped
+	state.ManuallyStopped++
+}
+
+func driftedServices(drift []compose.ServiceDrift) []string {
+	services := []string{}
+	for _, s := range drift {
+		services = append(services, s.Service)
+	}
+	return services
+}
+
+// rollback redeploys the last known good revision of an updated stack that
+// failed to start. Image pull failures and refused unpinned images are
+// skipped, as the old version is still running.
+func (g *GitOps) rollback(d *deployment.Deployment) bool {
+	if d.State != deployment.Updated || d.Error == deployment.ErrImagePullBackoff || errors.Is(d.Error, deployment.ErrUnpinnedImage) {
+		return false
+	}
+
+	g.knownGoodMu.Lock()
+	revision, ok := g.knownGood[d.Filepath]
+	g.knownGoodMu.Unlock()
+	if !ok || revision.Hash == d.Revision().Hash {
+		slog.Warn("no known good revision to roll back to", "file", d.Filepath)
+		return false
+	}
+
+	slog.Info("rolling back deployment", "file", d.Filepath, "commit", revision.Commit)
+	if err := d.Rollback(revision); err != nil {
+		slog.Error("error rolling back deployment", "file", d.Filepath, "commit", revision.Commit, "err", err)
+		return false
+	}
+
+	slog.Warn("rolled back deployment to last known good revision", "file", d.Filepath, "commit", revision.Commit, "failedCommit", d.Commit)
+	return true
+}
+
+// restoreKnownGood restores the known good revision of a stack after a
+// restart from the last applied version. It is the checked out version, or
+// loaded from the last applied commit if the checked out version was not
+// applied (e.g. it failed and was rolled back).
+func (g *GitOps) restoreKnownGood(d *deployment.Deployment) {
+	if !g.isFirstCheck {
+		return
+	}
+	stack, ok := g.store.Get(d.Filepath)
+	if !ok || stack.Hash == "" {
+		return
+	}
+
+	g.knownGoodMu.Lock()
+	_, ok = g.knownGood[d.Filepath]
+	g.knownGoodMu.Unlock()
+	if ok {
+		return
+	}
+
+	revision := d.Revision()
+	if d.Hash() != stack.Hash {
+		var err error
+		revision, err = g.loadRevision(d.Filepath, stack.Commit)
+		if err != nil {
+			slog.Warn("failed to restore last applied revision", "file", d.Filepath, "commit", stack.Commit, "err", err)
+			return
+		}
+		if revision.Hash != stack.Hash {
+			slog.Debug("restored revision differs from the last applied version (files of the working tree changed)", "file", d.Filepath, "commit", stack.Commit)
+		}
+	}
+
+	g.knownGoodMu.Lock()
+	g.knownGood[d.Filepath] = revision
+	g.knownGoodMu.Unlock()
+}
+
+// loadRevision loads a stack from a copy of the given commit. Paths of the
+// project refer to the worktree (like a revision loaded before a pull).
+func (g *GitOps) loadRevision(composeFile, commit string) (deployment.Revision, error) {
+	if commit == "" {
+		return deployment.Revision{}, deployment.ErrNoKnownGoodRevision
+	}
+
+	exportDirectory, err := os.MkdirTemp("", "gitops-revision-*")
+	if err != nil {
+		return deployment.Revision{}, err
+	}
+	defer os.RemoveAll(exportDirectory)
+
+	root := filepath.Join(exportDirectory, filepath.Base(g.repo.Path()))
+	if err := g.repo.ExportCommit(commit, root); err != nil {
+		return deployment.Revision{}, err
+	}
+
+	relative, err := filepath.Rel(g.repo.Path(), composeFile)
+	if err != nil {
+		return deployment.Revision{}, err
+	}
+	exported := filepath.Join(root, relative)
+
+	// Untracked .env file (kept by pulls)
+	if err := copyIfMissing(filepath.Join(filepath.Dir(composeFile), ".env"), filepath.Join(filepath.Dir(exported), ".env")); err != nil {
+		return deployment.Revision{}, err
+	}
+
+	options := append(slices.Clone(g.composeOptions), compose.WithWorkingDirectory(filepath.Dir(composeFile)))
+	d := deployment.NewDeployment(g.docker, exported, options...)
+	d.SetPathAlias(root, g.repo.Path())
+	d.Commit = commit
+	if err := d.LoadConfig(); err != nil {
+		return deployment.Revision{}, err
+	}
+	return d.Revision(), nil
+}
+
+// CheckRequest scopes a check. Without changed paths all stacks are
+// reconciled, otherwise unchanged stacks are only reconciled if one of the
+// paths (relative to the repository) touches them.
+type CheckRequest struct {
+	ChangedPaths []string
+}
+
+func (r CheckRequest) isScoped() bool {
+	return r.ChangedPaths != nil
+}
+
+func (g *GitOps) checkAndUpdateDeployments(targetCommit string, req CheckRequest, state *metrics.DeploymentState) ([]*deployment.Deployment, error) {
+	// Get local and target compose files
 	localComposeFiles, err := g.repo.GetLocalComposeFiles()
 	if err != nil {
 		slog.Error("error getting local compose files", "err", err)
 		return []*deployment.Deployment{}, err
 	}
 
-	remoteComposeFiles, err := g.repo.GetRemoteComposeFiles()
+	remoteComposeFiles, err := g.repo.GetComposeFiles(targetCommit)
 	if err != nil {
 		slog.Error("error getting remote compose files", "err", err)
 		return []*deployment.Deployment{}, err
@@ -113,12 +394,14 @@ func (g *GitOps) checkAndUpdateDeployments(state *metrics.DeploymentState) ([]*d
 	// Determine which deployments to add, remove, or update
 	deployments := []*deployment.Deployment{}
 	for _, localFile := range localComposeFiles {
-		d := deployment.NewDeployment(g.docker, localFile)
+		d := deployment.NewDeployment(g.docker, localFile, g.composeOptions...)
+		d.Commit = g.deployedCommit
 
 		err := d.LoadConfig()
 		if err != nil {
 			slog.Error("error loading deployment config", "file", d.Filepath, "err", err)
 		}
+		g.restoreKnownGood(d)
 
 		if !slices.Contains(remoteComposeFiles, localFile) {
 			d.State = deployment.Removed
@@ -127,7 +410,7 @@ func (g *GitOps) checkAndUpdateDeployments(state *metrics.DeploymentState) ([]*d
 	}
 	for _, remoteFile := range remoteComposeFiles {
 		if !slices.Contains(localComposeFiles, remoteFile) {
-			d := deployment.NewDeployment(g.docker, remoteFile)
+			d := deployment.NewDeployment(g.docker, remoteFile, g.composeOptions...)
 			d.State = deployment.Added
 			deployments = append(deployments, d)
 		}
@@ -140,25 +423,33 @@ func (g *GitOps) checkAndUpdateDeployments(state *metrics.DeploymentState) ([]*d
 		return []*deployment.Deployment{}, err
 	}
 
-	// Stop removed deployments
+	// Stop removed deployments (before pulling, the compose files are still present)
+	removed := []*deployment.Deployment{}
 	for _, d := range deployments {
 		if d.IsIgnored() || d.IsController() {
 			continue
 		}
 		if d.State == deployment.Removed {
-			g.applyDeploymentChange(d, state)
+			removed = append(removed, d)
 		}
 	}
+	g.applyInOrder(removed, true, state)
 
-	// Pull Git changes
-	if err := g.repo.Pull(); err != nil {
-		slog.Error("error pulling changes", "err", err)
+	// Pull Git changes (exactly the pinned target commit)
+	if err := g.repo.Pull(targetCommit); err != nil {
+		slog.Error("error pulling changes", "commit", targetCommit, "err", err)
 		return deployments, err
 	}
+	if g.deployedCommit != targetCommit {
+		slog.Info("checked out target commit", "commit", targetCommit, "previous", g.deployedCommit)
+	}
+	g.deployedCommit = targetCommit
+	g.store.SetDeployedCommit(targetCommit)
 
 	// Update deployment states (check if compose files are valid and if they changed)
 	for _, d := range deployments {
 		if d.State != deployment.Removed {
+			d.Commit = targetCommit
 			err := d.LoadConfig()
 			if err != nil {
 				slog.Error("error loading deployment config", "file", d.Filepath, "err", err)
@@ -166,13 +457,43 @@ func (g *GitOps) checkAndUpdateDeployments(state *metrics.DeploymentState) ([]*d
 		}
 	}
 
+	// Detect stacks that changed while gitops was not running (persisted hash differs)
+	if g.isFirstCheck {
+		for _, d := range deployments {
+			if d.State != deployment.Unchanged || d.Hash() == "" {
+				continue
+			}
+			if stack, ok := g.store.Get(d.Filepath); ok && stack.Hash != "" && stack.Hash != d.Hash() {
+				slog.Info("deployment changed since last run", "file", d.Filepath, "commit", stack.Commit)
+				d.State = deployment.Updated
+			}
+		}
+	}
+
+	changedPaths := []string{}
+	for _, p := range req.ChangedPaths {
+		changedPaths = append(changedPaths, filepath.Join(g.repo.Path(), p))
+	}
+
 	// Update deployments (add, changed, unchanged)
+	pending := []*deployment.Deployment{}
 	for _, d := range deployments {
 		if d.IsIgnored() || d.IsController() || d.State == deployment.Removed {
 			continue
 		}
-		g.applyDeploymentChange(d, state)
+		if g.isManuallyStopped(d) {
+			g.skipManuallyStopped(d, state)
+			continue
+		}
+		if req.isScoped() && !g.isFirstCheck && d.State == deployment.Unchanged && !d.IsAffectedBy(changedPaths) {
+			state.Unchanged++
+			slog.Debug("skipping deployment not touched by webhook push", "file", d.Filepath)
+			continue
+		}
+		pending = append(pending, d)
 	}
+	g.warnUnknownDependencies(deployments)
+	g.applyInOrder(pending, false, state)
 
 	// Post deployment operations
 	for _, d := range deployments {
@@ -197,8 +518,7 @@ func (g *GitOps) checkAndUpdateDeployments(state *metrics.DeploymentState) ([]*d
 				}
 			case deployment.Updated:
 				{
-					slog.Error("update controller deployment is not implemented yet", "file", d.Filepath)
-					// TODO: skip for docker desktop or non-docker use
+					g.updateController(d, state)
 				}
 			}
 		}
@@ -207,14 +527,33 @@ func (g *GitOps) checkAndUpdateDeployments(state *metrics.DeploymentState) ([]*d
 	return deployments, nil
 }
 
-func (g *GitOps) CheckAndUpdate() {
+func (g *GitOps) CheckAndUpdate(req CheckRequest) {
 	if g.isFirstCheck {
 		defer func() {
 			g.isFirstCheck = false
 		}()
 	}
 
-	hasChanges, err := g.repo.HasChanges()
+	if g.deployedCommit == "" {
+		localCommit, err := g.repo.GetLocalCommit()
+		if err != nil {
+			slog.Warn("error getting local commit", "err", err)
+		}
+		g.deployedCommit = localCommit
+
+		if persistedCommit := g.store.DeployedCommit(); persistedCommit != "" && persistedCommit != localCommit {
+			slog.Warn("local commit differs from last deployed commit", "commit", localCommit, "deployedCommit", persistedCommit)
+		}
+	}
+
+	defer func() {
+		if err := g.store.Save(); err != nil {
+			slog.Error("error saving state", "err", err)
+		}
+	}()
+
+	// Pin the target commit for this check, all decisions refer to it
+	targetCommit, hasChanges, err := g.repo.HasChanges()
 
 	if err != nil {
 		g.metrics.TrackCheckStatus("error")
@@ -223,7 +562,7 @@ func (g *GitOps) CheckAndUpdate() {
 	} else {
 		g.metrics.TrackCheckStatus("success")
 		if hasChanges {
-			slog.Info("git changes detected")
+			slog.Info("git changes detected", "commit", targetCommit)
 		} else if g.isFirstCheck {
 			slog.Info("first run, ensure all deployments are running")
 		} else {
@@ -242,13 +581,14 @@ func (g *GitOps) CheckAndUpdate() {
 
 	if hasChanges || g.isFirstCheck {
 		state := metrics.NewState()
-		deployments, err := g.checkAndUpdateDeployments(state)
+		deployments, err := g.checkAndUpdateDeployments(targetCommit, req, state)
 		if err != nil {
 			slog.Error("error checking and updating deployments", "err", err)
 			g.metrics.TrackCheckStatus("error")
 			return
 		}
 		g.metrics.TrackState(state, true)
+		g.updateDeployments(deployments)
 
 		for _, d := range deployments {
 			if d.Error == deployment.ErrImagePullBackoff {
@@ -257,7 +597,7 @@ func (g *GitOps) CheckAndUpdate() {
 		}
 
 		if state.HasChanges() {
-			slog.Info("deployment changes applied")
+			slog.Info("deployment changes applied", "commit", g.deployedCommit)
 		} else {
 			slog.Info("no deployment changes necessary")
 		}
@@ -271,5 +611,6 @@ func (g *GitOps) CheckAndUpdate() {
 			}
 		}
 		g.metrics.TrackState(state, false)
+		g.refreshDeployments()
 	}
 }
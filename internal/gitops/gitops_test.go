@@ -0,0 +1,121 @@
+package gitops
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	gitConfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
+	"github.com/korbiniankuhn/gitops-compose/internal/docker"
+	"github.com/korbiniankuhn/gitops-compose/internal/git"
+	"github.com/korbiniankuhn/gitops-compose/internal/store"
+)
+
+// newTestRepo creates an empty repository with an origin remote
+func newTestRepo(t *testing.T) (string, *gogit.Repository, *git.DeploymentRepo) {
+	t.Helper()
+
+	dir := t.TempDir()
+	r, err := gogit.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CreateRemote(&gitConfig.RemoteConfig{Name: "origin", URLs: []string{"https://example.com/stacks.git"}}); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := git.NewDeploymentRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, r, repo
+}
+
+// commitFile writes the file (relative to the repository) and commits it
+func commitFile(t *testing.T, r *gogit.Repository, name, content string) string {
+	t.Helper()
+
+	worktree, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(worktree.Filesystem.Root(), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := worktree.Commit("update "+name, &gogit.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
+
+func loadDeployment(t *testing.T, composeFile, commit string) *deployment.Deployment {
+	t.Helper()
+
+	d := deployment.NewDeployment(docker.NewDocker(nil), composeFile)
+	d.Commit = commit
+	if err := d.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestRestoreKnownGood(t *testing.T) {
+	dir, r, repo := newTestRepo(t)
+	composeFile := filepath.Join(dir, "app", "compose.yaml")
+
+	// The untracked .env file and bind mounts are resolved in the worktree
+	if err := os.MkdirAll(filepath.Dir(composeFile), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app", ".env"), []byte("TAG=1.27\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	good := commitFile(t, r, "app/compose.yaml", "services:\n  app:\n    image: nginx:${TAG}\n    volumes:\n      - ./config:/config\n")
+	applied := loadDeployment(t, composeFile, good)
+
+	failed := commitFile(t, r, "app/compose.yaml", "services:\n  app:\n    image: nginx:${TAG}-broken\n    volumes:\n      - ./config:/config\n")
+	checkedOut := loadDeployment(t, composeFile, failed)
+
+	tests := []struct {
+		name       string
+		checkedOut *deployment.Deployment
+		want       deployment.Revision
+	}{
+		{"checked out version was applied", applied, applied.Revision()},
+		{"checked out version was rolled back", checkedOut, applied.Revision()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := store.NewStore("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.RecordApplied(composeFile, good, applied.Hash())
+			g := NewGitOps(repo, docker.NewDocker(nil), nil, WithStore(s))
+
+			g.restoreKnownGood(tt.checkedOut)
+
+			got, ok := g.knownGood[composeFile]
+			if !ok {
+				t.Fatal("no known good revision restored")
+			}
+			if got.Commit != tt.want.Commit || got.Hash != tt.want.Hash {
+				t.Errorf("known good = %s (%s), want %s (%s)", got.Commit, got.Hash, tt.want.Commit, tt.want.Hash)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package gitops
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+
+	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
+	"github.com/korbiniankuhn/gitops-compose/internal/metrics"
+)
+
+var ErrDependencyCycle = fmt.Errorf("dependency cycle")
+
+// dependencyLevels orders deployments by their x-gitops.depends_on stacks.
+// Deployments of a level only depend on deployments of earlier levels.
+// Dependencies outside of the given deployments are already applied and
+// ignored, deployments that are part of (or depend on) a cycle are returned
+// separately.
+func (g *GitOps) dependencyLevels(deployments []*deployment.Deployment) ([][]*deployment.Deployment, []*deployment.Deployment) {
+	byName := map[string]*deployment.Deployment{}
+	for _, d := range deployments {
+		byName[g.deploymentName(d)] = d
+	}
+
+	pending := map[*deployment.Deployment][]*deployment.Deployment{}
+	for _, d := range deployments {
+		dependencies := []*deployment.Deployment{}
+		for _, name := range d.DependsOn() {
+			if dependency, ok := byName[path.Clean(name)]; ok && dependency != d && !slices.Contains(dependencies, dependency) {
+				dependencies = append(dependencies, dependency)
+			}
+		}
+		pending[d] = dependencies
+	}
+
+	levels := [][]*deployment.Deployment{}
+	done := map[*deployment.Deployment]bool{}
+	for len(done) < len(deployments) {
+		level := []*deployment.Deployment{}
+		for _, d := range deployments {
+			if done[d] {
+				continue
+			}
+			ready := true
+			for _, dependency := range pending[d] {
+				if !done[dependency] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				level = append(level, d)
+			}
+		}
+		if len(level) == 0 {
+			break
+		}
+		for _, d := range level {
+			done[d] = true
+		}
+		levels = append(levels, level)
+	}
+
+	cyclic := []*deployment.Deployment{}
+	for _, d := range deployments {
+		if !done[d] {
+			cyclic = append(cyclic, d)
+		}
+	}
+
+	return levels, cyclic
+}
+
+// warnUnknownDependencies logs dependencies that are no stack of the repository
+func (g *GitOps) warnUnknownDependencies(deployments []*deployment.Deployment) {
+	names := []string{}
+	for _, d := range deployments {
+		if d.State != deployment.Removed {
+			names = append(names, g.deploymentName(d))
+		}
+	}
+	for _, d := range deployments {
+		if d.State == deployment.Removed {
+			continue
+		}
+		for _, name := range d.DependsOn() {
+			if !slices.Contains(names, path.Clean(name)) {
+				slog.Warn("unknown stack in x-gitops depends_on", "file", d.Filepath, "dependency", name)
+			}
+		}
+	}
+}
+
+// applyInOrder applies the deployments level by level (dependencies first, or
+// dependants first when reversed for removals). Deployments in a cycle fail.
+func (g *GitOps) applyInOrder(deployments []*deployment.Deployment, reverse bool, state *metrics.DeploymentState) {
+	levels, cyclic := g.dependencyLevels(deployments)
+
+	for _, d := range cyclic {
+		d.Error = ErrDependencyCycle
+		g.store.RecordError(d.Filepath, ErrDependencyCycle)
+		state.Failed++
+		slog.Error("skipping deployment with cyclic x-gitops depends_on", "file", d.Filepath, "dependsOn", d.DependsOn())
+	}
+
+	if reverse {
+		slices.Reverse(levels)
+	}
+	for _, level := range levels {
+		g.applyDeploymentChanges(level, state)
+	}
+}
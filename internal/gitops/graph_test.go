@@ -0,0 +1,116 @@
+package gitops
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
+	"github.com/korbiniankuhn/gitops-compose/internal/docker"
+)
+
+// newTestDeployments creates a repository with a stack per name (depending on
+// the listed stacks) and loads their deployments in the given order.
+func newTestDeployments(t *testing.T, names []string, dependsOn map[string][]string) (*GitOps, []*deployment.Deployment) {
+	t.Helper()
+
+	dir, _, repo := newTestRepo(t)
+
+	deployments := []*deployment.Deployment{}
+	for _, name := range names {
+		content := "services:\n  app:\n    image: nginx\n"
+		if len(dependsOn[name]) > 0 {
+			content += "x-gitops:\n  depends_on: [" + strings.Join(dependsOn[name], ", ") + "]\n"
+		}
+
+		composeFile := filepath.Join(dir, name, "compose.yaml")
+		if err := os.MkdirAll(filepath.Dir(composeFile), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(composeFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		d := deployment.NewDeployment(docker.NewDocker(nil), composeFile)
+		if err := d.LoadConfig(); err != nil {
+			t.Fatal(err)
+		}
+		deployments = append(deployments, d)
+	}
+
+	return &GitOps{repo: repo}, deployments
+}
+
+func TestDependencyLevels(t *testing.T) {
+	tests := []struct {
+		name      string
+		stacks    []string
+		dependsOn map[string][]string
+		levels    [][]string
+		cyclic    []string
+	}{
+		{
+			name:   "independent",
+			stacks: []string{"a", "b"},
+			levels: [][]string{{"a", "b"}},
+			cyclic: []string{},
+		},
+		{
+			name:      "chain",
+			stacks:    []string{"app", "proxy", "db"},
+			dependsOn: map[string][]string{"app": {"db", "./proxy"}, "proxy": {"db"}},
+			levels:    [][]string{{"db"}, {"proxy"}, {"app"}},
+			cyclic:    []string{},
+		},
+		{
+			name:      "dependency missing from the set",
+			stacks:    []string{"app", "proxy"},
+			dependsOn: map[string][]string{"app": {"db"}, "proxy": {"app"}},
+			levels:    [][]string{{"app"}, {"proxy"}},
+			cyclic:    []string{},
+		},
+		{
+			name:      "self dependency",
+			stacks:    []string{"app"},
+			dependsOn: map[string][]string{"app": {"app"}},
+			levels:    [][]string{{"app"}},
+			cyclic:    []string{},
+		},
+		{
+			name:      "cycle",
+			stacks:    []string{"a", "b", "c", "d"},
+			dependsOn: map[string][]string{"a": {"b"}, "b": {"a"}, "c": {"a"}},
+			levels:    [][]string{{"d"}},
+			cyclic:    []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, deployments := newTestDeployments(t, tt.stacks, tt.dependsOn)
+
+			levels, cyclic := g.dependencyLevels(deployments)
+
+			names := [][]string{}
+			for _, level := range levels {
+				names = append(names, deploymentNames(g, level))
+			}
+			if !slices.EqualFunc(names, tt.levels, slices.Equal) {
+				t.Errorf("levels = %v, want %v", names, tt.levels)
+			}
+			if got := deploymentNames(g, cyclic); !slices.Equal(got, tt.cyclic) {
+				t.Errorf("cyclic = %v, want %v", got, tt.cyclic)
+			}
+		})
+	}
+}
+
+func deploymentNames(g *GitOps, deployments []*deployment.Deployment) []string {
+	names := []string{}
+	for _, d := range deployments {
+		names = append(names, g.deploymentName(d))
+	}
+	return names
+}
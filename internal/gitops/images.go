@@ -0,0 +1,75 @@
+package gitops
+
+import (
+	"log/slog"
+
+	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
+	"github.com/korbiniankuhn/gitops-compose/internal/metrics"
+)
+
+// ImageUpdateRequest redeploys stacks with image updates enabled whose image
+// tags point to a new registry digest.
+type ImageUpdateRequest struct{}
+
+func (r ImageUpdateRequest) process(g *GitOps) {
+	g.CheckImageUpdates()
+}
+
+func (g *GitOps) CheckImageUpdates() {
+	g.mu.RLock()
+	entries := g.deployments
+	g.mu.RUnlock()
+
+	slog.Info("checking for image updates")
+
+	state := metrics.NewState()
+	for _, e := range entries {
+		existing := e.deployment
+		if existing.State == deployment.RolledBack || existing.State == deployment.Unhealthy || existing.Error == deployment.ErrImagePullBackoff {
+			continue
+		}
+
+		d := deployment.NewDeployment(g.docker, existing.Filepath, g.composeOptions...)
+		d.Commit = g.deployedCommit
+		if err := d.LoadConfig(); err != nil {
+			slog.Error("error loading deployment config", "file", d.Filepath, "err", err)
+			continue
+		}
+		if d.IsIgnored() || d.IsController() || !d.ImageUpdatesEnabled() || g.isManuallyStopped(d) {
+			continue
+		}
+
+		images, err := d.UpdatedImages()
+		if err != nil {
+			slog.Error("error checking image updates", "file", d.Filepath, "err", err)
+			continue
+		}
+		if len(images) == 0 {
+			continue
+		}
+
+		if err := d.PullUpdatedImages(images); err != nil {
+			// Retried on the next image update check, the old images keep running
+			slog.Error("error pulling updated images", "file", d.Filepath, "err", err)
+			state.Failed++
+			continue
+		}
+
+		slog.Info("redeploying deployment due to image updates", "file", d.Filepath, "images", images)
+		d.MarkImagesUpdated()
+		g.applyDeploymentChange(d, state)
+		g.replaceDeployment(existing, d)
+	}
+
+	g.metrics.TrackImageUpdates(state)
+
+	if err := g.store.Save(); err != nil {
+		slog.Error("error saving state", "err", err)
+	}
+
+	if state.HasChanges() {
+		slog.Info("image updates applied", "updated", state.Updated)
+	} else {
+		slog.Info("no image updates applied")
+	}
+}
@@ -0,0 +1,264 @@
+package gitops
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
+)
+
+type PlanAction string
+
+const (
+	PlanAdd       PlanAction = "add"
+	PlanRemove    PlanAction = "remove"
+	PlanUpdate    PlanAction = "update"
+	PlanStart     PlanAction = "start"
+	PlanUnchanged PlanAction = "unchanged"
+	PlanIgnore    PlanAction = "ignore"
+	PlanInvalid   PlanAction = "invalid"
+)
+
+type StackPlan struct {
+	Name    string           `json:"name"`
+	Path    string           `json:"path"`
+	Action  PlanAction       `json:"action"`
+	Reasons []string         `json:"reasons,omitempty"`
+	Diff    *deployment.Diff `json:"diff,omitempty"`
+}
+
+// Plan is what a check would do with the remote head
+type Plan struct {
+	LocalCommit  string      `json:"localCommit"`
+	TargetCommit string      `json:"targetCommit"`
+	Stacks       []StackPlan `json:"stacks"`
+}
+
+// PlanResult is the outcome of a PlanRequest
+type PlanResult struct {
+	Plan Plan
+	Err  error
+}
+
+// PlanRequest computes a plan in the check loop (it fetches the remote). The
+// outcome is sent to Result (which should be buffered).
+type PlanRequest struct {
+	Result chan<- PlanResult
+}
+
+func (r PlanRequest) process(g *GitOps) {
+	plan, err := g.Plan()
+	if r.Result != nil {
+		r.Result <- PlanResult{Plan: plan, Err: err}
+	}
+}
+
+// Plan fetches the remote and compares the checked out stacks with the stacks
+// of the remote head without pulling or touching containers. The remote
+// version is loaded from a copy of the target commit and, like a check, a
+// stack is updated when its hash changes. Stacks are also updated when they
+// differ from the last applied version or (if enabled) an image digest
+// changed.
+func (g *GitOps) Plan() (Plan, error) {
+	targetCommit, _, err := g.repo.HasChanges()
+	if err != nil {
+		return Plan{}, fmt.Errorf("failed to fetch remote: %w", err)
+	}
+
+	localCommit, err := g.repo.GetLocalCommit()
+	if err != nil {
+		return Plan{}, err
+	}
+
+	localComposeFiles, err := g.repo.GetLocalComposeFiles()
+	if err != nil {
+		return Plan{}, err
+	}
+
+	remoteComposeFiles, err := g.repo.GetComposeFiles(targetCommit)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	changedFiles, err := g.repo.ChangedFiles(localCommit, targetCommit)
+	if err != nil {
+		return Plan{}, err
+	}
+	changed := []string{}
+	for _, f := range changedFiles {
+		changed = append(changed, filepath.Join(g.repo.Path(), f))
+	}
+
+	// Copy of the target commit (the project name is derived from the
+	// directories, so the repository directory name is kept)
+	exportDirectory, err := os.MkdirTemp("", "gitops-plan-*")
+	if err != nil {
+		return Plan{}, err
+	}
+	defer os.RemoveAll(exportDirectory)
+
+	targetRoot := filepath.Join(exportDirectory, filepath.Base(g.repo.Path()))
+	if err := g.repo.ExportCommit(targetCommit, targetRoot); err != nil {
+		return Plan{}, err
+	}
+
+	plan := Plan{
+		LocalCommit:  localCommit,
+		TargetCommit: targetCommit,
+		Stacks:       []StackPlan{},
+	}
+
+	for _, localFile := range localComposeFiles {
+		d := deployment.NewDeployment(g.docker, localFile, g.composeOptions...)
+		d.Commit = localCommit
+		if err := d.LoadConfig(); err != nil {
+			slog.Debug("error loading deployment config", "file", d.Filepath, "err", err)
+		}
+
+		stack := StackPlan{
+			Name: g.deploymentName(d),
+			Path: d.Filepath,
+		}
+
+		if !slices.Contains(remoteComposeFiles, localFile) {
+			stack.Action = PlanRemove
+			stack.Reasons = []string{"compose file removed from git"}
+		} else if d.IsIgnored() {
+			stack.Action = PlanIgnore
+			stack.Reasons = []string{"gitops.ignore label"}
+		} else {
+			target := g.loadTarget(localFile, targetRoot, d.Files(), changed)
+			stack.Action, stack.Reasons, stack.Diff = g.planStack(d, target)
+		}
+
+		plan.Stacks = append(plan.Stacks, stack)
+	}
+
+	for _, remoteFile := range remoteComposeFiles {
+		if slices.Contains(localComposeFiles, remoteFile) {
+			continue
+		}
+		d := deployment.NewDeployment(g.docker, remoteFile, g.composeOptions...)
+		target := g.loadTarget(remoteFile, targetRoot, nil, changed)
+		stack := StackPlan{
+			Name:    g.deploymentName(d),
+			Path:    remoteFile,
+			Action:  PlanAdd,
+			Reasons: []string{"compose file added to git"},
+		}
+		if target.Hash() == "" {
+			stack.Action = PlanInvalid
+			stack.Reasons = append(stack.Reasons, "invalid compose file in the target commit")
+		} else if target.IsIgnored() {
+			stack.Action = PlanIgnore
+			stack.Reasons = []string{"gitops.ignore label"}
+		}
+		plan.Stacks = append(plan.Stacks, stack)
+	}
+
+	return plan, nil
+}
+
+// loadTarget loads the stack of a compose file from the copy of the target
+// commit. Files of the stack that are not tracked by git (e.g. an ignored
+// .env file) are copied from the worktree, as a pull keeps them.
+func (g *GitOps) loadTarget(composeFile, targetRoot string, files []string, changed []string) *deployment.Deployment {
+	files = append(files, filepath.Join(filepath.Dir(composeFile), ".env"))
+	for _, f := range files {
+		if slices.Contains(changed, f) {
+			continue
+		}
+		relative, err := filepath.Rel(g.repo.Path(), f)
+		if err != nil || strings.HasPrefix(relative, "..") {
+			continue
+		}
+		if err := copyIfMissing(f, filepath.Join(targetRoot, relative)); err != nil {
+			slog.Debug("error copying untracked file", "file", f, "err", err)
+		}
+	}
+
+	relative, _ := filepath.Rel(g.repo.Path(), composeFile)
+	target := deployment.NewDeployment(g.docker, filepath.Join(targetRoot, relative), g.composeOptions...)
+	target.SetPathAlias(targetRoot, g.repo.Path())
+	if err := target.LoadConfig(); err != nil {
+		slog.Debug("error loading target deployment config", "file", composeFile, "err", err)
+	}
+	return target
+}
+
+func copyIfMissing(source, target string) error {
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	content, err := os.ReadFile(source)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, content, 0o600)
+}
+
+func (g *GitOps) planStack(d, target *deployment.Deployment) (PlanAction, []string, *deployment.Diff) {
+	reasons := []string{}
+	var diff *deployment.Diff
+
+	if target.Hash() == "" {
+		return PlanInvalid, []string{"invalid compose file in the target commit"}, nil
+	}
+
+	if d.Hash() != target.Hash() {
+		if d.Hash() == "" {
+			reasons = append(reasons, "invalid compose file in the checked out commit")
+		}
+		changes, err := target.DiffFrom(d)
+		if err != nil {
+			slog.Warn("error comparing deployment versions", "file", d.Filepath, "err", err)
+		}
+		if changes.IsEmpty() {
+			reasons = append(reasons, "compose files or profiles changed")
+		} else {
+			reasons = append(reasons, changes.Summary()...)
+			diff = &changes
+		}
+	}
+
+	if stack, ok := g.store.Get(d.Filepath); ok && stack.Hash != "" && d.Hash() != "" && stack.Hash != d.Hash() {
+		reasons = append(reasons, "checked out version differs from the last applied version")
+	}
+
+	if d.ImageUpdatesEnabled() {
+		images, err := d.UpdatedImages()
+		if err != nil {
+			slog.Warn("error checking image updates", "file", d.Filepath, "err", err)
+		}
+		for _, image := range images {
+			reasons = append(reasons, "image digest changed: "+image)
+		}
+	}
+
+	if len(reasons) > 0 {
+		if target.IsController() {
+			reasons = append(reasons, "controller stack is updated through a helper container")
+		}
+		return PlanUpdate, reasons, diff
+	}
+
+	if !d.IsController() {
+		status, err := d.Status()
+		if err != nil {
+			slog.Warn("error getting service status", "file", d.Filepath, "err", err)
+		} else if incomplete := status.Incomplete(); len(incomplete) > 0 {
+			return PlanStart, []string{fmt.Sprintf("services not running: %v", incomplete)}, nil
+		}
+	}
+
+	return PlanUnchanged, nil, nil
+}
@@ -0,0 +1,90 @@
+package gitops
+
+import (
+	"log/slog"
+
+	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
+	"github.com/korbiniankuhn/gitops-compose/internal/metrics"
+)
+
+// ReconcileRequest ensures all stacks of the checked out commit are running,
+// independent of git changes.
+type ReconcileRequest struct{}
+
+func (r ReconcileRequest) process(g *GitOps) {
+	g.Reconcile()
+}
+
+// Reconcile runs the unchanged path (ensure running, drift) for all managed
+// stacks of the deployed commit. Rolled back and unhealthy stacks and stacks
+// waiting for an image pull retry are left to the next check, manually
+// stopped stacks to the next sync or restart.
+func (g *GitOps) Reconcile() {
+	g.mu.RLock()
+	entries := g.deployments
+	g.mu.RUnlock()
+
+	slog.Info("reconciliation started", "commit", g.deployedCommit, "deployments", len(entries))
+
+	state := metrics.NewState()
+	carried := metrics.NewState()
+	deployments := []*deployment.Deployment{}
+	pending := []*deployment.Deployment{}
+	for _, e := range entries {
+		existing := e.deployment
+
+		if existing.State == deployment.RolledBack {
+			carried.RolledBack++
+			deployments = append(deployments, existing)
+			slog.Debug("skipping rolled back deployment during reconciliation", "file", existing.Filepath)
+			continue
+		}
+		if existing.State == deployment.Unhealthy {
+			carried.Unhealthy++
+			deployments = append(deployments, existing)
+			slog.Debug("skipping unhealthy deployment during reconciliation", "file", existing.Filepath)
+			continue
+		}
+		if existing.Error == deployment.ErrImagePullBackoff {
+			carried.Failed++
+			deployments = append(deployments, existing)
+			slog.Debug("skipping deployment scheduled for retry during reconciliation", "file", existing.Filepath)
+			continue
+		}
+
+		d := deployment.NewDeployment(g.docker, existing.Filepath, g.composeOptions...)
+		d.Commit = g.deployedCommit
+		if err := d.LoadConfig(); err != nil {
+			slog.Error("error loading deployment config", "file", d.Filepath, "err", err)
+		}
+		deployments = append(deployments, d)
+
+		if d.IsIgnored() {
+			state.Ignored++
+			continue
+		}
+		if d.IsController() {
+			state.Unchanged++
+			continue
+		}
+		if g.isManuallyStopped(d) {
+			g.skipManuallyStopped(d, carried)
+			continue
+		}
+		pending = append(pending, d)
+	}
+	g.applyInOrder(pending, false, state)
+
+	g.updateDeployments(deployments)
+	g.metrics.TrackReconcile(state, carried)
+
+	if err := g.store.Save(); err != nil {
+		slog.Error("error saving state", "err", err)
+	}
+
+	if state.HasChanges() {
+		slog.Info("reconciliation corrected deployments", "started", state.Started, "updated", state.Updated)
+	} else {
+		slog.Info("reconciliation found no deployments to correct")
+	}
+}
@@ -0,0 +1,135 @@
+package gitops
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
+	"github.com/korbiniankuhn/gitops-compose/internal/metrics"
+)
+
+var (
+	ErrDeploymentNotFound   = fmt.Errorf("deployment not found")
+	ErrDeploymentNotManaged = fmt.Errorf("deployment is ignored or the gitops controller")
+	ErrUnknownAction        = fmt.Errorf("unknown action")
+)
+
+// Request is processed by the serialized check loop (see Process)
+type Request interface {
+	process(g *GitOps)
+}
+
+func (r CheckRequest) process(g *GitOps) {
+	g.CheckAndUpdate(r)
+}
+
+type Action string
+
+const (
+	ActionSync    Action = "sync"
+	ActionRestart Action = "restart"
+	ActionStop    Action = "stop"
+)
+
+// ActionRequest runs a manual operation on a single stack. The outcome is
+// sent to Result (which should be buffered).
+type ActionRequest struct {
+	Name   string
+	Action Action
+	Result chan<- error
+}
+
+func (r ActionRequest) process(g *GitOps) {
+	err := g.applyAction(r.Name, r.Action)
+	if r.Result != nil {
+		r.Result <- err
+	}
+}
+
+// Process runs a request, callers must ensure requests are processed one at a
+// time so they never race with the reconciler.
+func (g *GitOps) Process(req Request) {
+	req.process(g)
+}
+
+func (g *GitOps) findDeployment(name string) (*deployment.Deployment, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for _, e := range g.deployments {
+		if e.status.Name == name {
+			return e.deployment, true
+		}
+	}
+	return nil, false
+}
+
+func (g *GitOps) replaceDeployment(old, updated *deployment.Deployment) {
+	g.mu.RLock()
+	deployments := []*deployment.Deployment{}
+	for _, e := range g.deployments {
+		if e.deployment == old {
+			deployments = append(deployments, updated)
+		} else {
+			deployments = append(deployments, e.deployment)
+		}
+	}
+	g.mu.RUnlock()
+
+	g.updateDeployments(deployments)
+}
+
+func (g *GitOps) applyAction(name string, action Action) error {
+	existing, ok := g.findDeployment(name)
+	if !ok {
+		return ErrDeploymentNotFound
+	}
+
+	// Work on a fresh deployment of the checked out compose file
+	d := deployment.NewDeployment(g.docker, existing.Filepath, g.composeOptions...)
+	d.Commit = g.deployedCommit
+	if err := d.LoadConfig(); err != nil {
+		slog.Error("error loading deployment config", "file", d.Filepath, "err", err)
+	}
+	if d.IsIgnored() || d.IsController() {
+		return ErrDeploymentNotManaged
+	}
+
+	slog.Info("running manual deployment action", "file", d.Filepath, "action", action)
+
+	state := metrics.NewState()
+	switch action {
+	case ActionSync:
+		g.store.SetStopped(d.Filepath, false)
+		if stack, ok := g.store.Get(d.Filepath); ok && stack.Hash != "" && stack.Hash != d.Hash() {
+			d.State = deployment.Updated
+		}
+		g.applyDeploymentChange(d, state)
+	case ActionRestart:
+		g.store.SetStopped(d.Filepath, false)
+		d.State = deployment.Updated
+		g.applyDeploymentChange(d, state)
+	case ActionStop:
+		if _, err := d.Stop(); err != nil {
+			state.Failed++
+			slog.Error("error stopping deployment", "file", d.Filepath, "err", err)
+		} else {
+			state.Stopped++
+			d.State = deployment.Stopped
+			g.store.SetStopped(d.Filepath, true)
+			slog.Info("stopped deployment manually (until the next sync or restart)", "file", d.Filepath)
+		}
+	default:
+		return ErrUnknownAction
+	}
+
+	g.metrics.TrackAction(string(action), state, d.Error == nil)
+
+	g.replaceDeployment(existing, d)
+
+	if err := g.store.Save(); err != nil {
+		slog.Error("error saving state", "err", err)
+	}
+
+	return d.Error
+}
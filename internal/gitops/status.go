@@ -0,0 +1,190 @@
+package gitops
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/korbiniankuhn/gitops-compose/internal/compose"
+	"github.com/korbiniankuhn/gitops-compose/internal/deployment"
+)
+
+type DeploymentStatus struct {
+	Name              string                    `json:"name"`
+	Path              string                    `json:"path"`
+	State             string                    `json:"state"`
+	Hash              string                    `json:"hash"`
+	Ignored           bool                      `json:"ignored"`
+	Controller        bool                      `json:"controller"`
+	LastError         string                    `json:"lastError,omitempty"`
+	LastAppliedCommit string                    `json:"lastAppliedCommit,omitempty"`
+	LastAppliedAt     *time.Time                `json:"lastAppliedAt,omitempty"`
+	Drift             []compose.ServiceDrift    `json:"drift,omitempty"`
+	Diff              *deployment.Diff          `json:"diff,omitempty"`
+	Services          []compose.ServiceStatus   `json:"services"`
+	Containers        []compose.ContainerStatus `json:"containers"`
+	Images            []deployment.ImageReport  `json:"images"`
+}
+
+// deploymentName is the directory of the compose file relative to the repository
+func (g *GitOps) deploymentName(d *deployment.Deployment) string {
+	name, err := filepath.Rel(g.repo.Path(), filepath.Dir(d.Filepath))
+	if err != nil {
+		return filepath.Dir(d.Filepath)
+	}
+	return filepath.ToSlash(name)
+}
+
+type deploymentEntry struct {
+	deployment *deployment.Deployment
+	status     DeploymentStatus
+}
+
+// updateDeployments replaces the deployments exposed through the status API.
+// Must be called from the check loop, the status is snapshotted to not race
+// with later checks.
+func (g *GitOps) updateDeployments(deployments []*deployment.Deployment) {
+	entries := []deploymentEntry{}
+	for _, d := range deployments {
+		if d.State != deployment.Removed {
+			entries = append(entries, deploymentEntry{
+				deployment: d,
+				status:     g.getStatus(d),
+			})
+		}
+	}
+
+	g.trackImages(entries)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.deployments = entries
+}
+
+// trackImages exports the images running for each service as metrics
+func (g *GitOps) trackImages(entries []deploymentEntry) {
+	g.metrics.ResetImages()
+	for _, e := range entries {
+		if e.deployment.IsIgnored() {
+			continue
+		}
+		images, err := e.deployment.Images()
+		if err != nil {
+			slog.Debug("error getting images", "file", e.deployment.Filepath, "err", err)
+			continue
+		}
+		for _, image := range images {
+			g.metrics.TrackImage(e.status.Name, image.Service, image.Image, image.Digest, image.Pinned)
+		}
+	}
+}
+
+// refreshDeployments snapshots the status of the current deployments again
+func (g *GitOps) refreshDeployments() {
+	g.mu.RLock()
+	deployments := []*deployment.Deployment{}
+	for _, e := range g.deployments {
+		deployments = append(deployments, e.deployment)
+	}
+	g.mu.RUnlock()
+
+	g.updateDeployments(deployments)
+}
+
+func (g *GitOps) getStatus(d *deployment.Deployment) DeploymentStatus {
+	status := DeploymentStatus{
+		Name:       g.deploymentName(d),
+		Path:       d.Filepath,
+		State:      d.State.String(),
+		Hash:       d.Hash(),
+		Ignored:    d.IsIgnored(),
+		Controller: d.IsController(),
+		Drift:      d.Drift,
+		Services:   []compose.ServiceStatus{},
+		Containers: []compose.ContainerStatus{},
+		Images:     []deployment.ImageReport{},
+	}
+
+	diff, err := d.Diff()
+	if err != nil {
+		slog.Debug("error getting diff", "file", d.Filepath, "err", err)
+	} else if !diff.IsEmpty() {
+		status.Diff = &diff
+	}
+
+	return status
+}
+
+// logDiff logs what changed in an updated deployment
+func logDiff(d *deployment.Deployment) {
+	diff, err := d.Diff()
+	if err != nil {
+		slog.Warn("error getting diff", "file", d.Filepath, "err", err)
+		return
+	}
+	if !diff.IsEmpty() {
+		slog.Info("deployment changes", "file", d.Filepath, "changes", diff.String())
+	}
+}
+
+// withLiveStatus adds the persisted and container state to a snapshot
+func (g *GitOps) withLiveStatus(e deploymentEntry) DeploymentStatus {
+	status := e.status
+
+	if stack, ok := g.store.Get(e.deployment.Filepath); ok {
+		status.LastError = stack.LastError
+		status.LastAppliedCommit = stack.Commit
+		if !stack.LastAppliedAt.IsZero() {
+			status.LastAppliedAt = &stack.LastAppliedAt
+		}
+	}
+
+	projectStatus, err := e.deployment.Status()
+	if err != nil {
+		slog.Warn("error getting service status", "file", e.deployment.Filepath, "err", err)
+	} else {
+		status.Services = projectStatus.Services
+	}
+
+	images, err := e.deployment.Images()
+	if err != nil {
+		slog.Warn("error getting images", "file", e.deployment.Filepath, "err", err)
+	} else {
+		status.Images = images
+	}
+
+	containers, err := e.deployment.Containers()
+	if err != nil {
+		slog.Warn("error getting container status", "file", e.deployment.Filepath, "err", err)
+	} else {
+		status.Containers = containers
+	}
+
+	return status
+}
+
+func (g *GitOps) ListDeployments() []DeploymentStatus {
+	g.mu.RLock()
+	entries := g.deployments
+	g.mu.RUnlock()
+
+	statuses := []DeploymentStatus{}
+	for _, e := range entries {
+		statuses = append(statuses, g.withLiveStatus(e))
+	}
+	return statuses
+}
+
+func (g *GitOps) GetDeployment(name string) (DeploymentStatus, bool) {
+	g.mu.RLock()
+	entries := g.deployments
+	g.mu.RUnlock()
+
+	for _, e := range entries {
+		if e.status.Name == name {
+			return g.withLiveStatus(e), true
+		}
+	}
+	return DeploymentStatus{}, false
+}
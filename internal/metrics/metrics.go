@@ -2,6 +2,8 @@ package metrics
 
 import (
 	"net/http"
+	"strconv"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -10,9 +12,14 @@ import (
 type Metrics struct {
 	checkTimestamp              *prometheus.GaugeVec
 	checkCounter                *prometheus.CounterVec
+	reconcileTimestamp          *prometheus.GaugeVec
+	reconcileCounter            *prometheus.CounterVec
+	imageUpdateCounter          *prometheus.CounterVec
+	actionCounter               *prometheus.CounterVec
 	deploymentTimestamp         *prometheus.GaugeVec
 	activeDeploymentsGauge      *prometheus.GaugeVec
 	deploymentOperationsCounter *prometheus.CounterVec
+	imageInfo                   *prometheus.GaugeVec
 	state                       *DeploymentState
 }
 
@@ -36,6 +43,42 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"status"},
 		),
+		reconcileTimestamp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "gitops",
+				Subsystem: "reconcile",
+				Name:      "timestamp_seconds",
+				Help:      "Unix timestamp of the last periodic reconciliation by status",
+			},
+			[]string{"status"},
+		),
+		reconcileCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "gitops",
+				Subsystem: "reconcile",
+				Name:      "total",
+				Help:      "Total number of periodic reconciliations by status",
+			},
+			[]string{"status"},
+		),
+		imageUpdateCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "gitops",
+				Subsystem: "image_updates",
+				Name:      "total",
+				Help:      "Total number of stack redeployments due to image updates by status",
+			},
+			[]string{"status"},
+		),
+		actionCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "gitops",
+				Subsystem: "actions",
+				Name:      "total",
+				Help:      "Total number of manual deployment actions by action and status",
+			},
+			[]string{"action", "status"},
+		),
 		deploymentTimestamp: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: "gitops",
@@ -63,6 +106,15 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"operation"},
 		),
+		imageInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "gitops",
+				Subsystem: "deployments",
+				Name:      "image_info",
+				Help:      "Image and resolved digest running for each service (always 1)",
+			},
+			[]string{"deployment", "service", "image", "digest", "pinned"},
+		),
 		state: NewState(),
 	}
 
@@ -70,6 +122,13 @@ func NewMetrics() *Metrics {
 	metrics.checkTimestamp.WithLabelValues("success").Set(0)
 	metrics.checkCounter.WithLabelValues("error").Add(0)
 	metrics.checkTimestamp.WithLabelValues("error").Set(0)
+	metrics.reconcileCounter.WithLabelValues("success").Add(0)
+	metrics.reconcileTimestamp.WithLabelValues("success").Set(0)
+	metrics.reconcileCounter.WithLabelValues("error").Add(0)
+	metrics.reconcileTimestamp.WithLabelValues("error").Set(0)
+
+	metrics.imageUpdateCounter.WithLabelValues("success").Add(0)
+	metrics.imageUpdateCounter.WithLabelValues("error").Add(0)
 
 	metrics.deploymentTimestamp.WithLabelValues("success").Set(0)
 	metrics.deploymentTimestamp.WithLabelValues("error").Set(0)
@@ -78,40 +137,57 @@ func NewMetrics() *Metrics {
 	metrics.activeDeploymentsGauge.WithLabelValues("failed").Add(0)
 	metrics.activeDeploymentsGauge.WithLabelValues("invalid").Add(0)
 	metrics.activeDeploymentsGauge.WithLabelValues("ignored").Add(0)
+	metrics.activeDeploymentsGauge.WithLabelValues("rolled_back").Add(0)
+	metrics.activeDeploymentsGauge.WithLabelValues("drifted").Add(0)
+	metrics.activeDeploymentsGauge.WithLabelValues("unhealthy").Add(0)
+	metrics.activeDeploymentsGauge.WithLabelValues("manually_stopped").Add(0)
 
 	metrics.deploymentOperationsCounter.WithLabelValues("started").Add(0)
 	metrics.deploymentOperationsCounter.WithLabelValues("stopped").Add(0)
 	metrics.deploymentOperationsCounter.WithLabelValues("updated").Add(0)
 	metrics.deploymentOperationsCounter.WithLabelValues("failed").Add(0)
 	metrics.deploymentOperationsCounter.WithLabelValues("invalid").Add(0)
+	metrics.deploymentOperationsCounter.WithLabelValues("rolled_back").Add(0)
+	metrics.deploymentOperationsCounter.WithLabelValues("unhealthy").Add(0)
 
 	return metrics
 }
 
 type DeploymentState struct {
-	Unchanged int
-	Started   int
-	Stopped   int
-	Updated   int
-	Failed    int
-	Invalid   int
-	Ignored   int
+	Unchanged  int
+	Started    int
+	Stopped    int
+	Updated    int
+	Failed     int
+	Invalid    int
+	Ignored    int
+	RolledBack int
+	Drifted    int
+	Unhealthy  int
+	// Stacks stopped through the api (left alone until a sync or restart)
+	ManuallyStopped int
+	mu              sync.Mutex
 }
 
 func NewState() *DeploymentState {
 	return &DeploymentState{
-		Unchanged: 0,
-		Started:   0,
-		Stopped:   0,
-		Updated:   0,
-		Failed:    0,
-		Invalid:   0,
-		Ignored:   0,
+		Unchanged:  0,
+		Started:    0,
+		Stopped:    0,
+		Updated:    0,
+		Failed:     0,
+		Invalid:    0,
+		Ignored:    0,
+		RolledBack: 0,
+		Drifted:    0,
+		Unhealthy:  0,
+
+		ManuallyStopped: 0,
 	}
 }
 
 func (s *DeploymentState) HasErrors() bool {
-	return s.Failed > 0 || s.Invalid > 0
+	return s.Failed > 0 || s.Invalid > 0 || s.RolledBack > 0 || s.Unhealthy > 0
 }
 
 func (s *DeploymentState) HasChanges() bool {
@@ -119,11 +195,33 @@ func (s *DeploymentState) HasChanges() bool {
 }
 
 func (s *DeploymentState) CountRunning() int {
-	return s.Unchanged + s.Started + s.Updated
+	return s.Unchanged + s.Started + s.Updated + s.RolledBack + s.Drifted
 }
 
 func (s *DeploymentState) CountTotal() int {
-	return s.Unchanged + s.Started + s.Stopped + s.Updated + s.Failed + s.Invalid + s.Ignored
+	return s.Unchanged + s.Started + s.Stopped + s.Updated + s.Failed + s.Invalid + s.Ignored + s.RolledBack + s.Drifted + s.Unhealthy + s.ManuallyStopped
+}
+
+// Merge adds the counts of another state, safe for concurrent use
+func (s *DeploymentState) Merge(o *DeploymentState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(o)
+}
+
+func (s *DeploymentState) add(o *DeploymentState) {
+	s.Failed += o.Failed
+	s.Invalid += o.Invalid
+	s.Unchanged += o.Unchanged
+	s.Started += o.Started
+	s.Stopped += o.Stopped
+	s.Updated += o.Updated
+	s.Ignored += o.Ignored
+	s.RolledBack += o.RolledBack
+	s.Drifted += o.Drifted
+	s.Unhealthy += o.Unhealthy
+	s.ManuallyStopped += o.ManuallyStopped
 }
 
 func (c *Metrics) TrackCheckStatus(status string) {
@@ -136,16 +234,83 @@ func (c *Metrics) TrackState(state *DeploymentState, replace bool) {
 		c.state = state
 	} else {
 		c.state.Failed -= state.CountTotal()
+		c.state.add(state)
+	}
+
+	c.trackActiveState()
 
-		c.state.Failed += state.Failed
-		c.state.Invalid += state.Invalid
-		c.state.Unchanged += state.Unchanged
-		c.state.Started += state.Started
-		c.state.Stopped += state.Stopped
-		c.state.Updated += state.Updated
-		c.state.Ignored += state.Ignored
+	// Operations
+	c.deploymentOperationsCounter.WithLabelValues("started").Add(float64(state.Started))
+	c.deploymentOperationsCounter.WithLabelValues("stopped").Add(float64(state.Stopped))
+	c.deploymentOperationsCounter.WithLabelValues("updated").Add(float64(state.Updated))
+	c.deploymentOperationsCounter.WithLabelValues("failed").Add(float64(state.Failed))
+	c.deploymentOperationsCounter.WithLabelValues("invalid").Add(float64(state.Invalid))
+	c.deploymentOperationsCounter.WithLabelValues("rolled_back").Add(float64(state.RolledBack))
+	c.deploymentOperationsCounter.WithLabelValues("unhealthy").Add(float64(state.Unhealthy))
+}
+
+// TrackReconcile replaces the active state after a periodic reconciliation.
+// Carried stacks were skipped (e.g. rolled back) and keep their state without
+// counting as operations.
+func (c *Metrics) TrackReconcile(state *DeploymentState, carried *DeploymentState) {
+	status := "success"
+	if state.Failed > 0 || state.Invalid > 0 || state.Unhealthy > 0 {
+		status = "error"
+	}
+	c.reconcileCounter.WithLabelValues(status).Inc()
+	c.reconcileTimestamp.WithLabelValues(status).SetToCurrentTime()
+
+	c.state = NewState()
+	c.state.add(state)
+	c.state.add(carried)
+	c.trackActiveState()
+
+	c.deploymentOperationsCounter.WithLabelValues("started").Add(float64(state.Started))
+	c.deploymentOperationsCounter.WithLabelValues("updated").Add(float64(state.Updated))
+	c.deploymentOperationsCounter.WithLabelValues("failed").Add(float64(state.Failed))
+	c.deploymentOperationsCounter.WithLabelValues("invalid").Add(float64(state.Invalid))
+	c.deploymentOperationsCounter.WithLabelValues("unhealthy").Add(float64(state.Unhealthy))
+}
+
+// TrackImageUpdates counts redeployments due to image updates. The active
+// state is refreshed by the next check or reconciliation.
+func (c *Metrics) TrackImageUpdates(state *DeploymentState) {
+	c.imageUpdateCounter.WithLabelValues("success").Add(float64(state.Updated))
+	c.imageUpdateCounter.WithLabelValues("error").Add(float64(state.Failed + state.Unhealthy + state.RolledBack))
+
+	c.deploymentOperationsCounter.WithLabelValues("updated").Add(float64(state.Updated))
+	c.deploymentOperationsCounter.WithLabelValues("failed").Add(float64(state.Failed))
+	c.deploymentOperationsCounter.WithLabelValues("rolled_back").Add(float64(state.RolledBack))
+	c.deploymentOperationsCounter.WithLabelValues("unhealthy").Add(float64(state.Unhealthy))
+}
+
+// TrackAction counts a manual action and its operations. The active state is
+// refreshed by the next check or reconciliation.
+func (c *Metrics) TrackAction(action string, state *DeploymentState, success bool) {
+	status := "success"
+	if !success {
+		status = "error"
 	}
+	c.actionCounter.WithLabelValues(action, status).Inc()
+
+	c.deploymentOperationsCounter.WithLabelValues("started").Add(float64(state.Started))
+	c.deploymentOperationsCounter.WithLabelValues("stopped").Add(float64(state.Stopped))
+	c.deploymentOperationsCounter.WithLabelValues("updated").Add(float64(state.Updated))
+	c.deploymentOperationsCounter.WithLabelValues("failed").Add(float64(state.Failed))
+	c.deploymentOperationsCounter.WithLabelValues("invalid").Add(float64(state.Invalid))
+	c.deploymentOperationsCounter.WithLabelValues("rolled_back").Add(float64(state.RolledBack))
+	c.deploymentOperationsCounter.WithLabelValues("unhealthy").Add(float64(state.Unhealthy))
+}
+
+func (c *Metrics) ResetImages() {
+	c.imageInfo.Reset()
+}
 
+func (c *Metrics) TrackImage(deployment, service, image, digest string, pinned bool) {
+	c.imageInfo.WithLabelValues(deployment, service, image, digest, strconv.FormatBool(pinned)).Set(1)
+}
+
+func (c *Metrics) trackActiveState() {
 	// Timestamps
 	if c.state.HasErrors() {
 		c.deploymentTimestamp.WithLabelValues("error").SetToCurrentTime()
@@ -158,13 +323,10 @@ func (c *Metrics) TrackState(state *DeploymentState, replace bool) {
 	c.activeDeploymentsGauge.WithLabelValues("failed").Set(float64(c.state.Failed))
 	c.activeDeploymentsGauge.WithLabelValues("invalid").Set(float64(c.state.Invalid))
 	c.activeDeploymentsGauge.WithLabelValues("ignored").Set(float64(c.state.Ignored))
-
-	// Operations
-	c.deploymentOperationsCounter.WithLabelValues("started").Add(float64(state.Started))
-	c.deploymentOperationsCounter.WithLabelValues("stopped").Add(float64(state.Stopped))
-	c.deploymentOperationsCounter.WithLabelValues("updated").Add(float64(state.Updated))
-	c.deploymentOperationsCounter.WithLabelValues("failed").Add(float64(state.Failed))
-	c.deploymentOperationsCounter.WithLabelValues("invalid").Add(float64(state.Invalid))
+	c.activeDeploymentsGauge.WithLabelValues("rolled_back").Set(float64(c.state.RolledBack))
+	c.activeDeploymentsGauge.WithLabelValues("drifted").Set(float64(c.state.Drifted))
+	c.activeDeploymentsGauge.WithLabelValues("unhealthy").Set(float64(c.state.Unhealthy))
+	c.activeDeploymentsGauge.WithLabelValues("manually_stopped").Set(float64(c.state.ManuallyStopped))
 }
 
 func (m *Metrics) GetMetricsHandler() http.Handler {
@@ -173,9 +335,14 @@ func (m *Metrics) GetMetricsHandler() http.Handler {
 	r.MustRegister(
 		m.checkTimestamp,
 		m.checkCounter,
+		m.reconcileTimestamp,
+		m.reconcileCounter,
+		m.imageUpdateCounter,
+		m.actionCounter,
 		m.deploymentTimestamp,
 		m.activeDeploymentsGauge,
 		m.deploymentOperationsCounter,
+		m.imageInfo,
 	)
 
 	handler := promhttp.HandlerFor(r, promhttp.HandlerOpts{})
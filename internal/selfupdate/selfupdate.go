@@ -0,0 +1,184 @@
+package selfupdate
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/compose/v2/pkg/api"
+	"github.com/docker/docker/api/types/container"
+	"github.com/korbiniankuhn/gitops-compose/internal/compose"
+)
+
+var (
+	ErrNoHandshake  = fmt.Errorf("no controller update requested")
+	ErrNotConfirmed = fmt.Errorf("updated controller did not confirm the start")
+	ErrNotUpdated   = fmt.Errorf("running controller is not the updated version")
+)
+
+const (
+	handshakeFilename = "controller-update.json"
+	pollInterval      = 2 * time.Second
+)
+
+// Handshake is shared between the old controller, the helper container and the
+// new controller through the state directory.
+type Handshake struct {
+	ID             string            `json:"id"`
+	File           string            `json:"file"`
+	Commit         string            `json:"commit"`
+	Hash           string            `json:"hash"`
+	ServiceHashes  map[string]string `json:"serviceHashes"`
+	RollbackImages map[string]string `json:"rollbackImages"`
+	RequestedAt    time.Time         `json:"requestedAt"`
+	ConfirmedAt    *time.Time        `json:"confirmedAt,omitempty"`
+	RolledBackAt   *time.Time        `json:"rolledBackAt,omitempty"`
+}
+
+func (h Handshake) IsPending() bool {
+	return h.ConfirmedAt == nil && h.RolledBackAt == nil
+}
+
+// Read returns the last handshake or nil if no update was requested
+func Read(directory string) (*Handshake, error) {
+	content, err := os.ReadFile(filepath.Join(directory, handshakeFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
+	}
+
+	var h Handshake
+	if err := json.Unmarshal(content, &h); err != nil {
+		return nil, fmt.Errorf("failed to parse handshake: %w", err)
+	}
+	return &h, nil
+}
+
+func Write(directory string, h *Handshake) error {
+	content, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal handshake: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(directory, handshakeFilename+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary handshake file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write handshake: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write handshake: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(directory, handshakeFilename)); err != nil {
+		return fmt.Errorf("failed to replace handshake: %w", err)
+	}
+	return nil
+}
+
+// Confirm is called by a starting controller with its own container. A pending
+// update is only confirmed by a container that was created by the update (a
+// restart of the previous controller or a rollback does not confirm). It
+// returns the handshake if the update was confirmed.
+func Confirm(directory string, self container.InspectResponse) (*Handshake, error) {
+	h, err := Read(directory)
+	if err != nil || h == nil || !h.IsPending() {
+		return nil, err
+	}
+
+	var labels map[string]string
+	if self.Config != nil {
+		labels = self.Config.Labels
+	}
+	service := labels[api.ServiceLabel]
+	expected, ok := h.ServiceHashes[service]
+	if !ok || labels[api.ConfigHashLabel] != expected {
+		return nil, fmt.Errorf("%w: service %q has a different configuration", ErrNotUpdated, service)
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, self.Created)
+	if err != nil || created.Before(h.RequestedAt) {
+		return nil, fmt.Errorf("%w: container was created before the update was requested", ErrNotUpdated)
+	}
+
+	now := time.Now()
+	h.ConfirmedAt = &now
+	if err := Write(directory, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// RunHelper runs in the short-lived helper container. It starts the updated
+// controller stack and waits for the new controller to confirm. Otherwise the
+// stack is started again with the kept images of the previous controller.
+func RunHelper(c *compose.ComposeFile, directory string, timeout time.Duration) error {
+	h, err := Read(directory)
+	if err != nil {
+		return err
+	}
+	if h == nil || !h.IsPending() {
+		return ErrNoHandshake
+	}
+
+	slog.Info("updating controller stack", "file", c.Filepath, "commit", h.Commit)
+	if err := start(c, nil); err != nil {
+		slog.Error("failed to start updated controller stack", "file", c.Filepath, "err", err)
+		return rollback(c, directory, h)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		current, err := Read(directory)
+		if err != nil {
+			slog.Warn("failed to read handshake", "err", err)
+		} else if current != nil && current.ID == h.ID && current.ConfirmedAt != nil {
+			slog.Info("updated controller confirmed the start", "commit", h.Commit)
+			return nil
+		}
+		time.Sleep(pollInterval)
+	}
+
+	slog.Error("updated controller did not confirm the start in time", "timeout", timeout)
+	return rollback(c, directory, h)
+}
+
+func rollback(c *compose.ComposeFile, directory string, h *Handshake) error {
+	slog.Info("rolling back controller stack to the previous images", "images", h.RollbackImages)
+	if err := start(c, h.RollbackImages); err != nil {
+		return fmt.Errorf("controller rollback failed: %w", err)
+	}
+
+	now := time.Now()
+	h.RolledBackAt = &now
+	if err := Write(directory, h); err != nil {
+		return err
+	}
+	return ErrNotConfirmed
+}
+
+// start runs compose up for the controller stack, optionally replacing the
+// images of services
+func start(c *compose.ComposeFile, images map[string]string) error {
+	project, err := c.LoadProject()
+	if err != nil {
+		return err
+	}
+
+	for name, service := range project.Services {
+		if image, ok := images[name]; ok {
+			service.Image = image
+			project.Services[name] = service
+		}
+	}
+
+	return c.StartProject(project)
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateFilename = "state.json"
+
+type StackState struct {
+	Hash          string    `json:"hash"`
+	Commit        string    `json:"commit"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastAppliedAt time.Time `json:"lastAppliedAt,omitempty"`
+	LastErrorAt   time.Time `json:"lastErrorAt,omitempty"`
+	Stopped       bool      `json:"stopped,omitempty"`
+}
+
+type State struct {
+	DeployedCommit string                 `json:"deployedCommit"`
+	UpdatedAt      time.Time              `json:"updatedAt"`
+	Stacks         map[string]*StackState `json:"stacks"`
+}
+
+// Store persists the reconciler state as a JSON file. Without a directory the
+// state is only kept in memory.
+type Store struct {
+	mu    sync.RWMutex
+	path  string
+	state State
+}
+
+func NewStore(directory string) (*Store, error) {
+	s := &Store{
+		state: State{
+			Stacks: map[string]*StackState{},
+		},
+	}
+
+	if directory == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	s.path = filepath.Join(directory, stateFilename)
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &s.state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	if s.state.Stacks == nil {
+		s.state.Stacks = map[string]*StackState{}
+	}
+
+	return s, nil
+}
+
+func (s *Store) IsPersistent() bool {
+	return s.path != ""
+}
+
+func (s *Store) DeployedCommit() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.state.DeployedCommit
+}
+
+func (s *Store) SetDeployedCommit(commit string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.DeployedCommit = commit
+}
+
+// Get returns a copy of the stack state (false if the stack is unknown).
+func (s *Store) Get(filepath string) (StackState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stack, ok := s.state.Stacks[filepath]
+	if !ok {
+		return StackState{}, false
+	}
+	return *stack, true
+}
+
+func (s *Store) stack(filepath string) *StackState {
+	stack, ok := s.state.Stacks[filepath]
+	if !ok {
+		stack = &StackState{}
+		s.state.Stacks[filepath] = stack
+	}
+	return stack
+}
+
+func (s *Store) RecordApplied(filepath, commit, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stack := s.stack(filepath)
+	stack.Commit = commit
+	stack.Hash = hash
+	stack.LastError = ""
+	stack.LastAppliedAt = time.Now()
+}
+
+func (s *Store) RecordError(filepath string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stack := s.stack(filepath)
+	stack.LastError = err.Error()
+	stack.LastErrorAt = time.Now()
+}
+
+// SetStopped marks a stack as manually stopped (it is not started again until
+// it is synced or restarted).
+func (s *Store) SetStopped(filepath string, stopped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stack(filepath).Stopped = stopped
+}
+
+func (s *Store) Remove(filepath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.state.Stacks, filepath)
+}
+
+// Save atomically writes the state file (no-op for in-memory stores).
+func (s *Store) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.UpdatedAt = time.Now()
+
+	content, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), stateFilename+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Push is the common subset of GitHub, GitLab and Gitea push payloads
+type Push struct {
+	Ref     string `json:"ref"`
+	Commits []struct {
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
+	} `json:"commits"`
+}
+
+// IsPing reports provider test events that must not trigger a check.
+func IsPing(r *http.Request) bool {
+	return r.Header.Get("X-GitHub-Event") == "ping"
+}
+
+// ParsePush parses a push payload. ok is false if the body is not a push
+// event (e.g. an empty manual trigger).
+func ParsePush(body []byte) (Push, bool) {
+	var push Push
+	if err := json.Unmarshal(body, &push); err != nil || push.Ref == "" {
+		return Push{}, false
+	}
+	return push, true
+}
+
+// Branch returns the pushed branch or an empty string for tag pushes
+func (p Push) Branch() string {
+	branch, ok := strings.CutPrefix(p.Ref, "refs/heads/")
+	if !ok {
+		return ""
+	}
+	return branch
+}
+
+// ChangedPaths returns all added, modified and removed paths of the push. It
+// returns nil if the payload contains no commits (e.g. a truncated list).
+func (p Push) ChangedPaths() []string {
+	if len(p.Commits) == 0 {
+		return nil
+	}
+
+	paths := []string{}
+	for _, c := range p.Commits {
+		for _, list := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, path := range list {
+				if !slices.Contains(paths, path) {
+					paths = append(paths, path)
+				}
+			}
+		}
+	}
+	return paths
+}
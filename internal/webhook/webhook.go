@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnknownProvider  = fmt.Errorf("unknown webhook provider")
+	ErrMissingSignature = fmt.Errorf("missing webhook signature")
+	ErrInvalidSignature = fmt.Errorf("invalid webhook signature")
+)
+
+type Provider string
+
+const (
+	GitHub  Provider = "github"
+	GitLab  Provider = "gitlab"
+	Gitea   Provider = "gitea"
+	Unknown Provider = "unknown"
+)
+
+type Delivery struct {
+	Provider Provider
+	ID       string
+}
+
+// DetectProvider identifies the webhook sender by its headers. Gitea is
+// checked first, as it also sends GitHub compatible headers.
+func DetectProvider(r *http.Request) Delivery {
+	switch {
+	case r.Header.Get("X-Gitea-Event") != "" || r.Header.Get("X-Gitea-Signature") != "":
+		return Delivery{Provider: Gitea, ID: r.Header.Get("X-Gitea-Delivery")}
+	case r.Header.Get("X-Gitlab-Event") != "" || r.Header.Get("X-Gitlab-Token") != "":
+		return Delivery{Provider: GitLab, ID: r.Header.Get("X-Gitlab-Event-UUID")}
+	case r.Header.Get("X-GitHub-Event") != "" || r.Header.Get("X-Hub-Signature-256") != "":
+		return Delivery{Provider: GitHub, ID: r.Header.Get("X-GitHub-Delivery")}
+	default:
+		return Delivery{Provider: Unknown}
+	}
+}
+
+func computeHMAC(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func verifyHMAC(signature string, secret string, body []byte) error {
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal(decoded, computeHMAC(secret, body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Verify checks the request signature of the detected provider against the
+// shared secret.
+func Verify(r *http.Request, body []byte, secret string) (Delivery, error) {
+	delivery := DetectProvider(r)
+
+	switch delivery.Provider {
+	case GitHub:
+		signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok {
+			return delivery, ErrMissingSignature
+		}
+		return delivery, verifyHMAC(signature, secret, body)
+	case Gitea:
+		return delivery, verifyHMAC(r.Header.Get("X-Gitea-Signature"), secret, body)
+	case GitLab:
+		token := r.Header.Get("X-Gitlab-Token")
+		if token == "" {
+			return delivery, ErrMissingSignature
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return delivery, ErrInvalidSignature
+		}
+		return delivery, nil
+	default:
+		return delivery, ErrUnknownProvider
+	}
+}
@@ -0,0 +1,51 @@
+package webhook
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	secret := "secret"
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	signature := hex.EncodeToString(computeHMAC(secret, body))
+	wrong := hex.EncodeToString(computeHMAC("other", body))
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		provider Provider
+		err      error
+	}{
+		{"github valid", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signature}, GitHub, nil},
+		{"github invalid", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + wrong}, GitHub, ErrInvalidSignature},
+		{"github missing", map[string]string{"X-GitHub-Event": "push"}, GitHub, ErrMissingSignature},
+		{"gitlab valid", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": secret}, GitLab, nil},
+		{"gitlab invalid", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "other"}, GitLab, ErrInvalidSignature},
+		{"gitlab missing", map[string]string{"X-Gitlab-Event": "Push Hook"}, GitLab, ErrMissingSignature},
+		{"gitea valid", map[string]string{"X-Gitea-Event": "push", "X-GitHub-Event": "push", "X-Gitea-Signature": signature}, Gitea, nil},
+		{"gitea invalid", map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": wrong}, Gitea, ErrInvalidSignature},
+		{"gitea not hex", map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": "zz"}, Gitea, ErrInvalidSignature},
+		{"gitea missing", map[string]string{"X-Gitea-Event": "push"}, Gitea, ErrMissingSignature},
+		{"unknown", map[string]string{}, Unknown, ErrUnknownProvider},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/webhook", nil)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			delivery, err := Verify(r, body, secret)
+			if delivery.Provider != tt.provider {
+				t.Errorf("provider = %s, want %s", delivery.Provider, tt.provider)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}